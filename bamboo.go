@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything Bambot needs from Bamboo. BambooClient talks to a real Bamboo server; tests use fakes.
+type Bamboo interface {
+	// The most recent builds in the activity stream published before a time (or the zero time, for the newest builds),
+	// most recent first
+	ListRecentResults(maxResults int, before time.Time) ([]RecentResult, error)
+	GetResult(buildKey string, buildNumber string) (BambooResult, error)
+	GetLabels(buildKey string, buildNumber string) ([]string, error)
+	AddLabel(buildKey string, buildNumber string, label string) error
+	AddComment(buildKey string, buildNumber string, content string) error
+	// The caller must close the log when done reading it
+	DownloadJobLog(job BambooJobResult) (io.ReadCloser, error)
+}
+
+// One build in the activity stream
+type RecentResult struct {
+	// Ex: https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33
+	Link       string
+	Published  time.Time
+	Successful bool
+	// The summary Bamboo wrote about the build, Ex: "2 tests failed"
+	Content string
+	// The build's result, if it's already been fetched (Ex: for a build from the webhook), so it isn't fetched again
+	Result *BambooResult
+}
+
+type BambooResult struct {
+	XMLName xml.Name `xml:"result"`
+	// Ex: <plan key="CRAB-CWS144" name="Crab - feature-branch-144"/>
+	Plan struct {
+		Key  string `xml:"key,attr"`
+		Name string `xml:"name,attr"`
+	} `xml:"plan"`
+	// The short name of the plan, which for a plan branch is the name of the branch, Ex: feature-branch-144
+	PlanName       string        `xml:"planName"`
+	VcsRevisionKey string        `xml:"vcsRevisionKey"`
+	BuildState     string        `xml:"buildState"`
+	Stages         []BambooStage `xml:"stages>stage"`
+	// How many tests Bamboo found failing, across all of the jobs
+	FailedTestCount int `xml:"failedTestCount"`
+}
+
+type BambooStage struct {
+	Name    string            `xml:"name,attr"`
+	Results []BambooJobResult `xml:"results>result"`
+}
+
+// The result of one job within a build, Ex: CRAB-CWS144-JOB1-33
+type BambooJobResult struct {
+	Key   string `xml:"key,attr"`
+	State string `xml:"state,attr"`
+	Job   struct {
+		Key       string `xml:"key,attr"`
+		ShortName string `xml:"shortName,attr"`
+	} `xml:"plan"`
+}
+
+// The jobs that failed in a build, across all of its stages
+func (result BambooResult) failedJobs() []BambooJobResult {
+	var jobs []BambooJobResult
+	for _, stage := range result.Stages {
+		for _, job := range stage.Results {
+			if job.State == "Failed" {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs
+}
+
+// The key of the job itself, Ex: CRAB-CWS144-JOB1
+func (job BambooJobResult) jobKey() string {
+	if job.Job.Key != "" {
+		return job.Job.Key
+	}
+	return job.Key[:strings.LastIndex(job.Key, "-")]
+}
+
+func (job BambooJobResult) name() string {
+	if job.Job.ShortName != "" {
+		return job.Job.ShortName
+	}
+	return job.jobKey()
+}
+
+// Talks to a Bamboo server over HTTP
+type BambooClient struct {
+	Url        string
+	HttpClient *http.Client
+
+	// Sometimes we use the JSessionID (to act like a browser)
+	// Other times we user an HTTP Basic authorization header (to use the REST API).
+	// The choice is based on which is easier and/or arbitrary historical choices.
+	JSessionId string
+	AuthHeader string
+	// With a personal access token, every request uses the REST API or the token, and there's no session at all
+	Token string
+	// Several builds are processed at the same time, while one of them might be logging in again
+	session sync.RWMutex
+}
+
+func newBambooClient(bambooUrl string, httpClient *http.Client) *BambooClient {
+	return &BambooClient{Url: bambooUrl, HttpClient: httpClient}
+}
+
+func buildAuthorizationHeader(username string, password string) string {
+	return "Basic " + b64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// Send a request to Bamboo, and read the whole response body.
+// It's an error if Bamboo doesn't respond with a 2xx status code.
+func (client *BambooClient) sendRequest(req *http.Request, operation string) ([]byte, error) {
+	return sendRequest(client.HttpClient, req, bambooService, operation)
+}
+
+// Log in with a username and password, which authenticates all future requests
+func (client *BambooClient) LogIn(username string, password string) error {
+	loginUrl := client.Url + "/userlogin.action"
+
+	form := url.Values{}
+	form.Set("os_destination", "/start.action")
+	form.Set("os_username", username)
+	form.Set("os_password", password)
+	req, err := http.NewRequest("POST", loginUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return &RequestError{Service: bambooService, Operation: "log in", Url: loginUrl, Err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return &RequestError{Service: bambooService, Operation: "log in", Url: loginUrl, Err: err}
+	}
+	_ = resp.Body.Close()
+
+	// We expect a status code of 302, and a redirect to /start.action
+	if resp.StatusCode != 302 {
+		return &RequestError{Service: bambooService, Operation: "log in", Url: loginUrl, StatusCode: resp.StatusCode, Message: "expected a response of 302"}
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return &RequestError{Service: bambooService, Operation: "log in", Url: loginUrl, StatusCode: resp.StatusCode, Err: err}
+	}
+	if location.String() != client.Url+"/start.action" {
+		return &RequestError{Service: bambooService, Operation: "log in", Url: loginUrl, StatusCode: resp.StatusCode, Message: "redirected to " + location.String()}
+	}
+	fmt.Println("Successful login!")
+
+	// Extract the JSESSIONID cookie, which we can use for future authenticated requests
+	setCookieHeader := resp.Header.Get("Set-Cookie")
+	re := regexp.MustCompile("JSESSIONID=([0-9A-Z]+).*")
+	submatches := re.FindStringSubmatch(setCookieHeader)
+	if submatches == nil {
+		return &RequestError{Service: bambooService, Operation: "log in", Url: loginUrl, StatusCode: resp.StatusCode, Message: "no JSESSIONID cookie"}
+	}
+	client.session.Lock()
+	defer client.session.Unlock()
+	client.JSessionId = submatches[1]
+	client.AuthHeader = buildAuthorizationHeader(username, password)
+	return nil
+}
+
+// Authenticate every request with a personal access token, instead of logging in
+func (client *BambooClient) UseToken(token string) {
+	client.session.Lock()
+	defer client.session.Unlock()
+	client.Token = token
+	client.AuthHeader = "Bearer " + token
+}
+
+func (client *BambooClient) usesToken() bool {
+	client.session.RLock()
+	defer client.session.RUnlock()
+	return client.Token != ""
+}
+
+// Pages for browsers accept the token too, so the session cookie is only needed without one
+func (client *BambooClient) authenticate(req *http.Request) {
+	if client.usesToken() {
+		req.Header.Set("Authorization", client.authorization())
+		return
+	}
+	req.Header.Add("Cookie", client.sessionCookie())
+}
+
+// The REST API only accepts a username and password in the Authorization header when asked to
+func (client *BambooClient) restUrl(path string) string {
+	if client.usesToken() {
+		return client.Url + path
+	}
+	return client.Url + path + "?os_authType=basic"
+}
+
+func (client *BambooClient) sessionCookie() string {
+	return "JSESSIONID=" + client.sessionId()
+}
+
+// Changes each time Bambot logs in
+func (client *BambooClient) sessionId() string {
+	client.session.RLock()
+	defer client.session.RUnlock()
+	return client.JSessionId
+}
+
+func (client *BambooClient) authorization() string {
+	client.session.RLock()
+	defer client.session.RUnlock()
+	return client.AuthHeader
+}
+
+// Read the Atom feed of the activity stream. Older pages are read by passing the time of the oldest build so far.
+// It's read with the token too, if there is one: the REST API only lists the latest results of each plan, so it has
+// no list of the newest builds across all plans like this one.
+func (client *BambooClient) ListRecentResults(maxResults int, before time.Time) ([]RecentResult, error) {
+	atomUrl := fmt.Sprintf("%s/plugins/servlet/streams?local=true&maxResults=%d", client.Url, maxResults)
+	if !before.IsZero() {
+		// The activity stream counts time in milliseconds
+		atomUrl += fmt.Sprintf("&maxDate=%d", before.UnixNano()/int64(time.Millisecond))
+	}
+	req, err := http.NewRequest("GET", atomUrl, nil)
+	if err != nil {
+		return nil, &RequestError{Service: bambooService, Operation: "read the activity stream", Url: atomUrl, Err: err}
+	}
+	client.authenticate(req)
+	body, err := client.sendRequest(req, "read the activity stream")
+	if err != nil {
+		return nil, err
+	}
+	atomFeedParser := gofeed.NewParser()
+	feed, err := atomFeedParser.ParseString(string(body))
+	if err != nil {
+		return nil, &RequestError{Service: bambooService, Operation: "read the activity stream", Url: atomUrl, Err: err}
+	}
+
+	var results []RecentResult
+	for _, item := range feed.Items {
+		if item.PublishedParsed == nil {
+			continue
+		}
+		result := RecentResult{Link: item.Link, Published: *item.PublishedParsed, Content: item.Content}
+		for _, category := range item.Categories {
+			if category == "build.successful" {
+				result.Successful = true
+			}
+		}
+		results = append(results, result)
+	}
+
+	// Sort by date, so most recent failure comes first
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Published.After(results[j].Published)
+	})
+	return results, nil
+}
+
+func (client *BambooClient) GetResult(buildKey string, buildNumber string) (BambooResult, error) {
+	getDetailsUrl := client.Url + "/rest/api/latest/result/" + buildKey + "/" + buildNumber + "?expand=artifacts&expand=changes&expand=results.result.artifacts&expand=results.result.labels&expand=results.result.comments&expand=results.result.jiraIssues&expand=changes.change&expand=changes.change.files&expand=metadata&expand=stages.stage.results"
+	var parsedResult BambooResult
+	req, err := http.NewRequest("GET", getDetailsUrl, nil)
+	if err != nil {
+		return parsedResult, &RequestError{Service: bambooService, Operation: "get build result", Url: getDetailsUrl, Err: err}
+	}
+	req.Header.Add("Authorization", client.authorization())
+	req.Header.Set("Content-Type", "application/xml")
+	body, err := client.sendRequest(req, "get build result")
+	if err != nil {
+		return parsedResult, err
+	}
+
+	err = xml.Unmarshal(body, &parsedResult)
+	if err != nil {
+		return parsedResult, &RequestError{Service: bambooService, Operation: "get build result", Url: getDetailsUrl, Err: err}
+	}
+	return parsedResult, nil
+}
+
+// The labels on a build, Ex:
+// <labels size="1"><label name="bambot-scanned"/></labels>
+type bambooLabels struct {
+	XMLName xml.Name `xml:"labels"`
+	Labels  []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"label"`
+}
+
+// Get the Bamboo labels on a build
+func (client *BambooClient) GetLabels(buildKey string, buildNumber string) ([]string, error) {
+	getLabelsUrl := client.restUrl("/rest/api/latest/result/" + buildKey + "-" + buildNumber + "/label")
+	req, err := http.NewRequest("GET", getLabelsUrl, nil)
+	if err != nil {
+		return nil, &RequestError{Service: bambooService, Operation: "get labels", Url: getLabelsUrl, Err: err}
+	}
+	req.Header.Add("Authorization", client.authorization())
+	req.Header.Set("Accept", "application/xml")
+	body, err := client.sendRequest(req, "get labels")
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedLabels bambooLabels
+	err = xml.Unmarshal(body, &parsedLabels)
+	if err != nil {
+		return nil, &RequestError{Service: bambooService, Operation: "get labels", Url: getLabelsUrl, Err: err}
+	}
+	var labels []string
+	for _, label := range parsedLabels.Labels {
+		labels = append(labels, label.Name)
+	}
+	return labels, nil
+}
+
+// Add a Bamboo label to a build
+func (client *BambooClient) AddLabel(buildKey string, buildNumber string, label string) error {
+	addLabelUrl := client.restUrl("/rest/api/latest/result/" + buildKey + "-" + buildNumber + "/label")
+	reqBody := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+	<label>
+		<name>` + escapeXmlString(label) + `</name>
+	</label>`
+	req, err := http.NewRequest("POST", addLabelUrl, strings.NewReader(reqBody))
+	if err != nil {
+		return &RequestError{Service: bambooService, Operation: "add label", Url: addLabelUrl, Err: err}
+	}
+	req.Header.Add("Authorization", client.authorization())
+	req.Header.Set("Content-Type", "application/xml")
+	_, err = client.sendRequest(req, "add label")
+	return err
+}
+
+func (client *BambooClient) AddComment(buildKey string, buildNumber string, commentContent string) error {
+	addCommentUrl := client.restUrl("/rest/api/latest/result/" + buildKey + "-" + buildNumber + "/comment")
+	reqBody := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+	<comment>
+		<content>` + escapeXmlString(commentContent) + `</content>
+	</comment>`
+	req, err := http.NewRequest("POST", addCommentUrl, strings.NewReader(reqBody))
+	if err != nil {
+		return &RequestError{Service: bambooService, Operation: "add comment", Url: addCommentUrl, Err: err}
+	}
+	req.Header.Add("Authorization", client.authorization())
+	req.Header.Set("Content-Type", "application/xml")
+	_, err = client.sendRequest(req, "add comment")
+	return err
+}
+
+func escapeXmlString(s string) string {
+	b := new(bytes.Buffer)
+	// Writing to a bytes.Buffer can't fail
+	_ = xml.EscapeText(b, []byte(s))
+	return b.String()
+}
+
+// Start downloading the log of one job
+func (client *BambooClient) DownloadJobLog(job BambooJobResult) (io.ReadCloser, error) {
+	downloadLogsUrl := client.Url + "/download/" + job.jobKey() + "/build_logs/" + job.Key + ".log?disposition=attachment"
+
+	// Download the logs!
+	req, err := http.NewRequest("GET", downloadLogsUrl, nil)
+	if err != nil {
+		return nil, &RequestError{Service: bambooService, Operation: "download logs", Url: downloadLogsUrl, Err: err}
+	}
+
+	client.authenticate(req)
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return nil, &RequestError{Service: bambooService, Operation: "download logs", Url: downloadLogsUrl, Err: err}
+	}
+	if resp.StatusCode != 200 {
+		_ = resp.Body.Close()
+		return nil, &RequestError{Service: bambooService, Operation: "download logs", Url: downloadLogsUrl, StatusCode: resp.StatusCode}
+	}
+
+	return resp.Body, nil
+}
+
+// The summary of a build where Bamboo found failing tests, worded like the activity stream, which is how Bambot
+// tells that tests failed. Ex: "2 tests failed", or "" if none did.
+func testsFailedContent(failedTestCount int) string {
+	if failedTestCount <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d tests failed", failedTestCount)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestLogIn(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+
+    client := server.newClient()
+    err := client.LogIn(server.username, server.password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, client.JSessionId, server.jSessionId)
+
+    client = server.newClient()
+    err = client.LogIn(server.username, "wrong")
+    if bambooErr, ok := err.(*RequestError); !ok || bambooErr.StatusCode != 200 {
+        t.Errorf("expected a failed login, but got '%v'", err)
+    }
+}
+
+// The login form is URL-encoded, so any password works
+func TestLogInWithSpecialCharacters(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+    server.password = "p&ss=w%rd+ 2"
+
+    client := server.newClient()
+    err := client.LogIn(server.username, server.password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, client.JSessionId, server.jSessionId)
+}
+
+func TestRequestsWithoutLoggingInFail(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+
+    client := server.newClient()
+    _, err := client.ListRecentResults(100, time.Time{})
+    if bambooErr, ok := err.(*RequestError); !ok || bambooErr.StatusCode != 302 {
+        t.Errorf("expected a redirect to the login page, but got '%v'", err)
+    }
+    _, err = client.GetResult("CRAB-CWS144", "33")
+    if bambooErr, ok := err.(*RequestError); !ok || bambooErr.StatusCode != 401 {
+        t.Errorf("expected an unauthorized error, but got '%v'", err)
+    }
+    _, err = client.GetLabels("CRAB-CWS144", "33")
+    if bambooErr, ok := err.(*RequestError); !ok || bambooErr.StatusCode != 401 {
+        t.Errorf("expected an unauthorized error, but got '%v'", err)
+    }
+}
+
+// With a personal access token, Bambot never logs in, and only needs the REST API and the log downloads
+func TestToken(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+
+    now := time.Now()
+    server.addEntry("CRAB-CWS144-JOB1-33", now, "build.failed", "")
+    server.results["CRAB-CWS144-33"] = `<result><planName>feature-144</planName><buildState>Failed</buildState></result>`
+    server.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    server.addEntry("CRAB-CWS145-JOB1-7", now.Add(-time.Minute), "build.failed", "")
+    server.labels["CRAB-CWS145-7"] = []string{"bambot-scanned"}
+    server.addEntry("CRAB-CWS146-JOB1-12", now.Add(-2*time.Minute), "build.failed", "2 tests failed")
+
+    client := server.newClient()
+    client.UseToken(server.token)
+    stats, err := handleAllBuilds(client, testRules, nil, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Errorf("expected no failures, but found %v", stats.failures)
+    }
+    assertEquals(t, fmt.Sprint(stats.counts), "map[commented:1 failed:0 scanned:3 skipped:2]")
+
+    comments := server.recordedComments("CRAB-CWS144-33")
+    if len(comments) != 1 {
+        t.Fatalf("expected one comment on CRAB-CWS144-33, but found %d", len(comments))
+    }
+    assertContains(t, comments[0], "Bambot detected an error!")
+    assertEquals(t, fmt.Sprint(server.recordedLabels("CRAB-CWS144-33")), "[bambot-scanned]")
+
+    for _, request := range server.recordedRequests() {
+        if request == "POST /userlogin.action" {
+            t.Errorf("expected the token to be used instead of logging in")
+        }
+    }
+
+    client = server.newClient()
+    client.UseToken("wrong")
+    _, err = client.ListRecentResults(100, time.Time{})
+    if bambooErr, ok := err.(*RequestError); !ok || bambooErr.StatusCode != 401 {
+        t.Errorf("expected an unauthorized error, but got '%v'", err)
+    }
+}
+
+// The whole flow, from logging in to posting comments, against the fake server
+func TestEndToEnd(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+
+    now := time.Now()
+    // A build with two failed jobs
+    server.addEntry("CRAB-CWS144-JOB1-33", now, "build.failed", "")
+    server.results["CRAB-CWS144-33"] = readFileToString("test_files/result-multiple-jobs.xml")
+    server.logs["CRAB-CWS144-JOB2-33"] = readFileToString("test_files/csharp-compiler-error.log")
+    server.logs["CRAB-CWS144-PYTEST-33"] = readFileToString("test_files/python-pytest.log")
+    // A build that Bambot already commented on
+    server.addEntry("CRAB-CWS145-JOB1-7", now.Add(-time.Minute), "build.failed", "")
+    server.labels["CRAB-CWS145-7"] = []string{"bambot-scanned"}
+    // A build without any details about its jobs
+    server.addEntry("CRAB-CWS146-JOB1-12", now.Add(-2*time.Minute), "build.failed", "")
+    server.results["CRAB-CWS146-12"] = `<result><planName>feature-146</planName><buildState>Failed</buildState></result>`
+    server.logs["CRAB-CWS146-JOB1-12"] = readFileToString("test_files/generic.log")
+    // A successful build on a release branch
+    server.addEntry("CRAB-CWO301-JOB1-5", now.Add(-3*time.Minute), "build.successful", "")
+    server.results["CRAB-CWO301-5"] = `<result><planName>release-R22.0.43</planName><buildState>Successful</buildState><vcsRevisionKey>abc123</vcsRevisionKey></result>`
+    // A build with a log Bambot doesn't understand
+    server.addEntry("CRAB-CWS147-JOB1-2", now.Add(-4*time.Minute), "build.failed", "")
+    server.results["CRAB-CWS147-2"] = `<result><planName>feature-147</planName><buildState>Failed</buildState></result>`
+    server.logs["CRAB-CWS147-JOB1-2"] = "nothing to see here"
+
+    client := server.newClient()
+    err := client.LogIn(server.username, server.password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stats, err := handleAllBuilds(client, testRules, nil, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Errorf("expected no failures, but found %v", stats.failures)
+    }
+
+    comments := server.recordedComments("CRAB-CWS144-33")
+    if len(comments) != 1 {
+        t.Fatalf("expected one comment on CRAB-CWS144-33, but found %d", len(comments))
+    }
+    assertContains(t, comments[0], "Bambot detected a C# compiler error (CS0103)!")
+    assertContains(t, comments[0], "In job .NET (CRAB-CWS144-JOB2-33)")
+    assertContains(t, comments[0], "Bambot detected a Python pytest error!")
+    assertContains(t, comments[0], "In job Python tests (CRAB-CWS144-PYTEST-33)")
+    assertContains(t, comments[0], "The name 'tagName' does not exist")
+    assertEquals(t, server.recordedLabels("CRAB-CWS144-33")[0], "bambot-scanned")
+
+    comments = server.recordedComments("CRAB-CWS146-12")
+    if len(comments) != 1 {
+        t.Fatalf("expected one comment on CRAB-CWS146-12, but found %d", len(comments))
+    }
+    assertContains(t, comments[0], "Bambot detected an error!")
+
+    for _, buildKeyAndNumber := range []string{"CRAB-CWS145-7", "CRAB-CWO301-5", "CRAB-CWS147-2"} {
+        if len(server.recordedComments(buildKeyAndNumber)) > 0 {
+            t.Errorf("expected no comment on %s", buildKeyAndNumber)
+        }
+    }
+    if len(server.recordedLabels("CRAB-CWS147-2")) > 0 {
+        t.Errorf("expected no label on CRAB-CWS147-2")
+    }
+    assertEquals(t, stats.branchNamesToLastGoodCommits["release/R22.0.43"], "abc123")
+
+    for _, request := range server.recordedRequests() {
+        if request == "GET /download/CRAB-CWS144-JOB1/build_logs/CRAB-CWS144-JOB1-33.log" {
+            t.Errorf("expected the successful job not to be downloaded")
+        }
+    }
+}
+
+// Older builds are read from the activity stream a page at a time
+func TestActivityStreamPaging(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+
+    // The feed only has whole seconds
+    now := time.Now().Truncate(time.Second)
+    for idx := 1; idx <= 150; idx++ {
+        server.addEntry("CRAB-CWS144-JOB1-"+strconv.Itoa(idx), now.Add(-time.Duration(150-idx)*time.Second), "build.failed", "")
+    }
+
+    client := server.newClient()
+    err := client.LogIn(server.username, server.password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    results, err := listRecentResults(client, nil, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 150 {
+        t.Fatalf("expected 150 results but found %d", len(results))
+    }
+    assertEquals(t, results[0].Link, server.URL+"/browse/CRAB-CWS144-JOB1-150")
+    assertEquals(t, results[149].Link, server.URL+"/browse/CRAB-CWS144-JOB1-1")
+
+    pages := 0
+    for _, request := range server.recordedRequests() {
+        if request == "GET /plugins/servlet/streams" {
+            pages++
+        }
+    }
+    if pages != 2 {
+        t.Errorf("expected 2 pages, but read %d", pages)
+    }
+}
@@ -1,566 +1,834 @@
 package main
 
 import (
-	"bytes"
-	b64 "encoding/base64"
-	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
-	"github.com/mmcdole/gofeed"
+	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"regexp"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 func main() {
-	// PARAMETERS
-	username, exists := os.LookupEnv("BAMBOO_USERNAME")
-	if !exists {
-		panic("Missing BAMBOO_USERNAME environment variable")
-	}
-	password, exists := os.LookupEnv("BAMBOO_PASSWORD")
-	if !exists {
-		panic("Missing BAMBOO_PASSWORD environment variable")
-	}
-	bambooUrl, exists := os.LookupEnv("BAMBOO_URL")
-	if !exists {
-		panic("Missing BAMBOO_URL environment variable")
+	args := os.Args[1:]
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	switch command {
+	case "run":
+		runCommand(args)
+	case "scan":
+		os.Exit(scanCommand(args, os.Stdin, os.Stdout, os.Stderr))
+	case "serve":
+		serveCommand(args)
+	case "history":
+		os.Exit(historyCommand(args, os.Stdout, os.Stderr))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, "Unknown command: "+command+"\n\n"+usage)
+		os.Exit(2)
 	}
+}
 
-	httpClient := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+// Scan the recent builds in Bamboo, and comment on the ones that failed
+func runCommand(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	rulesFile := flags.String("rules", rulesFileFromEnv(), "the rules file")
+	dryRun := flags.Bool("dry-run", isTrue(os.Getenv("BAMBOT_DRY_RUN")), "scan the logs, but only print the comments and labels instead of adding them")
+	reportFile := flags.String("report", os.Getenv("BAMBOT_DRY_RUN_REPORT"), "in a dry run, also write the comments and labels to this file as JSON")
+	storeFile := flags.String("store", storeFileFromEnv(), "the file where Bambot remembers the builds it has processed")
+	workers := flags.Int("workers", intFromEnv("BAMBOT_WORKERS", defaultWorkers), "how many builds to process at the same time")
+	httpOptions := addHttpFlags(flags)
+	jiraCreateAfter := flags.Int("jira-create-after", intFromEnv("BAMBOT_JIRA_CREATE_AFTER", 0), "file a JIRA issue for a failure once it's been found in this many builds, or never if 0")
+	_ = flags.Parse(args)
+
+	creds := credentialsFromEnv()
+	rules, err := loadRules(*rulesFile)
+	if err != nil {
+		exitWithError("Failed to load rules from " + *rulesFile + ": " + err.Error())
 	}
 
-	// Sometimes we use the JSessionID (to act like a browser)
-	// Other times we user an HTTP Basic authorization header (to use the REST API).
-	// The choice is based on which is easier and/or arbitrary historical choices.
-	jSessionId := logInToBamboo(bambooUrl, username, password, httpClient)
-	authHeader := buildAuthorizationHeader(username, password)
-
-	handleAllBuilds(bambooUrl, jSessionId, authHeader, httpClient)
-}
+	client := newBambooClient(creds.bambooUrl, newHttpClient(httpOptions))
+	err = creds.logIn(client)
+	if err != nil {
+		exitWithError(err.Error())
+	}
 
-func buildAuthorizationHeader(username string, password string) string {
-	return "Basic " + b64.StdEncoding.EncodeToString([]byte(username+":"+password))
-}
+	// In a dry run, the logs are scanned but nothing is written to Bamboo
+	var bamboo Bamboo = client
+	var dryRunBamboo *dryRunBamboo
+	if *dryRun {
+		dryRunBamboo = newDryRunBamboo(client)
+		bamboo = dryRunBamboo
+	}
 
-func logInToBamboo(bambooUrl string, username string, password string, httpClient *http.Client) string {
-	loginUrl := bambooUrl + "/userlogin.action"
+	integrations := &Integrations{
+		jira:  jiraTrackerFromEnv(*jiraCreateAfter, *dryRun, httpOptions),
+		slack: slackNotifierFromEnv(rules.Slack, *dryRun, httpOptions),
+	}
 
-	reqBody := strings.NewReader(`os_destination=%2Fstart.action&os_username=` + username + `&os_password=` + password)
-	req, err := http.NewRequest("POST", loginUrl, reqBody)
+	// A dry run reads the store, but doesn't add to it
+	var store *Store
+	if !*dryRun {
+		store, err = openStore(*storeFile)
+	} else if _, statErr := os.Stat(*storeFile); statErr == nil {
+		store, err = openStoreReadOnly(*storeFile)
+	}
 	if err != nil {
-		panic(err)
+		exitWithError("Failed to open the store " + *storeFile + ": " + err.Error())
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := httpClient.Do(req)
+	stats, err := handleAllBuilds(bamboo, rules, store, integrations, *workers, nil)
+	if store != nil {
+		closeErr := store.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
 	if err != nil {
-		panic(err)
+		exitWithError(err.Error())
 	}
 
-	// We expect a status code of 302, and a redirect to /start.action
-	if resp.StatusCode == 302 {
-		url, err := resp.Location()
+	if dryRunBamboo != nil && *reportFile != "" {
+		err = dryRunBamboo.writeReport(*reportFile)
 		if err != nil {
-			panic(err)
+			exitWithError("Failed to write dry run report to " + *reportFile + ": " + err.Error())
 		}
-		if url.String() == bambooUrl+"/start.action" {
-			fmt.Println("Successful login!")
-		} else {
-			panic("Failed login, redirected to " + url.String())
+	}
+
+	err = writeStringToFile("branchNamesToLastGoodCommits.txt", mapToText(stats.branchNamesToLastGoodCommits))
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	if len(stats.failures) > 0 {
+		fmt.Println("\nFailed to process", len(stats.failures), "build(s):")
+		for _, failure := range stats.failures {
+			fmt.Println(failure.Link, ":", redact(failure.Err.Error()))
 		}
-	} else {
-		panic("Failed login, response code was " + string(resp.StatusCode) + ", but we expect a response of 302")
+		os.Exit(1)
 	}
-	_ = resp.Body.Close()
+}
+
+// Builds published longer ago than this are too old to be worth scanning
+const lookbackWindow = 7 * 24 * time.Hour
+
+// How many builds to read from the activity stream at a time
+const recentResultsPageSize = 100
 
-	// Extract the JSESSIONID cookie, which we can use for future authenticated requests
-	setCookieHeader := resp.Header.Get("Set-Cookie")
-	re := regexp.MustCompile("JSESSIONID=([0-9A-Z]+).*")
-	jSessionId := re.FindStringSubmatch(setCookieHeader)[1]
-	return jSessionId
+// How many builds are processed at the same time, unless BAMBOT_WORKERS says otherwise
+const defaultWorkers = 4
+
+// How the date a failure was first seen is written in comments
+const occurrenceDateFormat = "02-Jan-2006"
+
+// Everything learned while handling the builds in the activity stream.
+// Builds are handled concurrently, so everything is updated with the mutex held.
+type scanStats struct {
+	mutex sync.Mutex
+
+	counts               map[string]int
+	maxHoursSincePublish float64
+	minHoursSincePublish float64
+
+	planNameToLastGoodCommit     map[string]string
+	branchNamesToLastGoodCommits map[string]string
+	// When the build with the last good commit of each plan was published
+	planNameToLastGoodPublished map[string]time.Time
+
+	failures []BuildFailure
 }
 
-func handleAllBuilds(bambooUrl string, jSessionId string, authHeader string, httpClient *http.Client) {
-	scanStartTime := time.Now()
-	fmt.Println("Starting scan at ", scanStartTime)
+func newScanStats() *scanStats {
+	stats := &scanStats{
+		counts:                       make(map[string]int),
+		maxHoursSincePublish:         -1.0,
+		minHoursSincePublish:         9999.0,
+		planNameToLastGoodCommit:     make(map[string]string),
+		branchNamesToLastGoodCommits: make(map[string]string),
+		planNameToLastGoodPublished:  make(map[string]time.Time),
+	}
+	stats.counts["scanned"] = 0
+	stats.counts["skipped"] = 0
+	stats.counts["commented"] = 0
+	stats.counts["failed"] = 0
+	return stats
+}
 
-	counts := make(map[string]int)
-	counts["scanned"] = 0
-	counts["skipped"] = 0
-	counts["commented"] = 0
+func (stats *scanStats) increment(count string) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.counts[count]++
+}
 
-	maxResults := 100
-	atomUrl := fmt.Sprintf("%s/plugins/servlet/streams?local=true&maxResults=%d", bambooUrl, maxResults)
-	req, err := http.NewRequest("GET", atomUrl, nil)
-	if err != nil {
-		panic(err)
+func (stats *scanStats) recordHoursSincePublish(hoursSincePublish float64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if hoursSincePublish > stats.maxHoursSincePublish {
+		stats.maxHoursSincePublish = hoursSincePublish
 	}
-	req.Header.Add("Cookie", "JSESSIONID="+jSessionId)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		panic(err)
+	if hoursSincePublish < stats.minHoursSincePublish {
+		stats.minHoursSincePublish = hoursSincePublish
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+}
+
+// Consider only the most recent successful build on each branch. Builds can finish being handled in any order,
+// so the one published most recently wins.
+func (stats *scanStats) recordGoodCommit(planName string, commit string, published time.Time) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if lastPublished, present := stats.planNameToLastGoodPublished[planName]; present && !published.After(lastPublished) {
+		return
 	}
-	err = resp.Body.Close()
-	if err != nil {
-		panic(err)
+	stats.planNameToLastGoodPublished[planName] = published
+	stats.planNameToLastGoodCommit[planName] = commit
+	if branchName, err := branchNameFromPlanName(planName); err == nil {
+		stats.branchNamesToLastGoodCommits[branchName] = commit
 	}
-	atomFeedParser := gofeed.NewParser()
-	feed, err := atomFeedParser.ParseString(string(body))
-	if err != nil {
-		panic(err)
-	}
-	// Sort by date, so most recent failure comes first
-	items := feed.Items
-	sort.Slice(items, func(i, j int) bool {
-		return items[i].PublishedParsed.Format(time.RFC3339) > items[j].PublishedParsed.Format(time.RFC3339)
-	})
-	maxHoursSincePublish := -1.0
-	minHoursSincePublish := 9999.0
-
-	planNameToLastGoodCommit := make(map[string]string)
-	branchNamesToLastGoodCommits := make(map[string]string)
-
-	for _, item := range items {
-		fmt.Println()
-		if num, ok := counts["scanned"]; ok {
-			counts["scanned"] = num + 1
-		}
-
-		link := item.Link
-		publishedTime := item.PublishedParsed.Format(time.RFC3339)
-		fmt.Print(link, " : ")
-
-		skipScan := false
-		isSuccess := false
-
-		// Keep only failures, which have a category of "build.failed"
-		for _, category := range item.Categories {
-			if category == "build.successful" {
-				fmt.Print("Skipping: Successful build ... ")
-				skipScan = true
-				isSuccess = true
-			}
-		}
+}
 
-		splitBySlash := strings.Split(link, "/")
-		buildId := splitBySlash[len(splitBySlash)-1] // Ex: CRAB-CWS144-JOB1-33
+func (stats *scanStats) addFailure(failure BuildFailure) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.counts["failed"]++
+	stats.failures = append(stats.failures, failure)
+}
 
-		splitByHyphen := strings.Split(buildId, "-")
-		if len(splitByHyphen) != 4 {
-			panic("Unexpected format of build ID: " + buildId)
+// Read the activity stream a page at a time, newest first, so that no failure falls off the end on a busy day.
+// Paging stops at the first page that reaches back past the lookback window, that includes a build
+// that's already recorded in the store, or that reaches the store's high-water mark. Builds published before the
+// mark have all been processed, so they aren't listed.
+func listRecentResults(bamboo Bamboo, store *Store, now time.Time) ([]RecentResult, error) {
+	var results []RecentResult
+	seen := make(map[string]bool)
+	before := time.Time{}
+	var mark time.Time
+	if store != nil {
+		var err error
+		mark, err = store.GetHighWaterMark()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for {
+		page, err := bamboo.ListRecentResults(recentResultsPageSize, before)
+		if err != nil {
+			return nil, err
 		}
-		buildNumber := splitByHyphen[3]
-
-		// According to the REST API, "buildKey" usually refers to CWS144 in the example above.
-		// But in other contexts (URL query parameters) it's CRAB-CWS144.
-		buildKey := strings.Join(splitByHyphen[0:2], "-")
 
-		// Read the existing labels on this build to find out if we've already processed it
-		labels := getLabels(bambooUrl, buildKey, buildNumber, jSessionId, httpClient)
+		newResults := 0
+		reachedProcessed := false
+		for _, result := range page {
+			// Pages can overlap, since several builds can be published at the same time
+			if seen[result.Link] {
+				continue
+			}
+			seen[result.Link] = true
+			newResults++
+			if result.Published.Before(mark) {
+				reachedProcessed = true
+				continue
+			}
+			results = append(results, result)
 
-		for _, label := range labels {
-			if label == "bambot-scanned" {
-				fmt.Print("Skipping: Bambot already scanned ... ")
-				skipScan = true
-			} else if strings.HasPrefix(label, "crab-") {
-				fmt.Print("Skipping: Already manually labeled ... ")
-				skipScan = true
+			if now.Sub(result.Published) > lookbackWindow || isRecorded(store, result) {
+				reachedProcessed = true
 			}
 		}
-
-		if strings.Contains(item.Content, "tests failed") {
-			// Skip this build, if Bamboo was able to parse the test failures we don't have any value to add
-			fmt.Print("Skipping: Bamboo found test failures ... ")
-			skipScan = true
+		if reachedProcessed || newResults == 0 || len(page) < recentResultsPageSize {
+			return results, nil
 		}
 
-		timeSincePublish := time.Now().Sub(*item.PublishedParsed)
-		hoursSincePublish := timeSincePublish.Hours()
-		if hoursSincePublish > maxHoursSincePublish {
-			maxHoursSincePublish = hoursSincePublish
+		// Continue with the builds published up to (and including) the oldest one so far
+		before = page[len(page)-1].Published.Add(time.Millisecond)
+		fmt.Println("Reading the activity stream before", before.Format(time.RFC3339))
+	}
+}
+
+// When the newest build was published that every build up to has been processed. Builds that couldn't be
+// processed are tried again next time, so the mark stays before the oldest of them.
+func highWaterMark(recentResults []RecentResult, failures []BuildFailure) time.Time {
+	failed := make(map[string]bool)
+	for _, failure := range failures {
+		failed[failure.Link] = true
+	}
+	var oldestFailure time.Time
+	for _, result := range recentResults {
+		if failed[result.Link] && (oldestFailure.IsZero() || result.Published.Before(oldestFailure)) {
+			oldestFailure = result.Published
 		}
-		if hoursSincePublish < minHoursSincePublish {
-			minHoursSincePublish = hoursSincePublish
+	}
+	var mark time.Time
+	for _, result := range recentResults {
+		if !oldestFailure.IsZero() && !result.Published.Before(oldestFailure) {
+			continue
 		}
-		if hoursSincePublish > 24*7 {
-			fmt.Print("Skipping: too old:", publishedTime, "...")
-			skipScan = true
+		if result.Published.After(mark) {
+			mark = result.Published
 		}
+	}
+	return mark
+}
 
-		if isSuccess {
-			result := getBuildResult(bambooUrl, buildKey, buildNumber, authHeader, httpClient)
-			if strings.Contains(buildKey, "CRAB-CWO") &&
-				result.BuildState == "Successful" {
-				// Consider only the most recent successful build on each branch
-				if _, present := planNameToLastGoodCommit[result.PlanName]; !present {
-					planNameToLastGoodCommit[result.PlanName] = result.VcsRevisionKey
-					if branchName, err := branchNameFromPlanName(result.PlanName); err == nil {
-						branchNamesToLastGoodCommits[branchName] = result.VcsRevisionKey
-					}
-				}
-			}
-		}
+// Has this failed build already been recorded in the store (if any)?
+func isRecorded(store *Store, result RecentResult) bool {
+	if store == nil || result.Successful {
+		return false
+	}
+	buildKey, buildNumber, err := parseBuildLink(result.Link)
+	if err != nil {
+		return false
+	}
+	_, found, err := store.GetBuild(buildKey + "-" + buildNumber)
+	return err == nil && found
+}
 
-		if skipScan {
-			if num, ok := counts["skipped"]; ok {
-				counts["skipped"] = num + 1
-			}
-			continue
-		}
+// Scan every recent build in the activity stream. Builds that can't be processed are returned as failures,
+// and don't stop the other builds from being processed. An error is returned only if the scan couldn't run at all.
+// Builds recorded in the store are skipped. Without a store (nil), only the labels show which builds were processed.
+// The findings are also shared with the integrations (if any), Ex: JIRA.
+// Up to workers builds are handled at the same time. Once stop is closed, no more builds are started, but the ones
+// in progress are finished. A nil stop never closes.
+func handleAllBuilds(bamboo Bamboo, rules *RulesFile, store *Store, integrations *Integrations, workers int, stop <-chan struct{}) (*scanStats, error) {
+	scanStartTime := time.Now()
+	fmt.Println("Starting scan at ", scanStartTime)
 
-		scanResult := scanBuild(bambooUrl, buildKey, buildNumber, jSessionId, httpClient)
+	stats := newScanStats()
 
-		if scanResult.Comment != "" {
-			if num, ok := counts["commented"]; ok {
-				counts["commented"] = num + 1
-			}
+	recentResults, err := listRecentResults(bamboo, store, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-			commentContent := ""
-			commentContent += scanResult.Comment + "\n\n"
-			if scanResult.JiraIssueId != "" {
-				commentContent += "This is a known issue in JIRA: " + scanResult.JiraIssueId + "\n\n"
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan RecentResult)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for recentResult := range queue {
+				handleAndReportBuild(recentResult, bamboo, rules, store, integrations, stats)
 			}
-			commentContent += "Log snippet:\n" + scanResult.LogSnippet
+		}()
+	}
+
+	// Builds are handed out newest first, as workers become free
+	stopped := false
+builds:
+	for _, recentResult := range recentResults {
+		// Check for stop first, since select picks at random when a worker is free too
+		select {
+		case <-stop:
+			fmt.Println("\nStopping before", recentResult.Link)
+			stopped = true
+			break builds
+		default:
+		}
+		select {
+		case <-stop:
+			fmt.Println("\nStopping before", recentResult.Link)
+			stopped = true
+			break builds
+		case queue <- recentResult:
+		}
+	}
+	close(queue)
+	waitGroup.Wait()
 
-			print("Adding comment & 'bambot-scanned' label")
-			addCommentWithApi(bambooUrl, buildKey, buildNumber, commentContent, authHeader, httpClient)
-			addLabel(bambooUrl, buildKey, buildNumber, "bambot-scanned", jSessionId, httpClient)
-		} else {
-			print("Couldn't find cause of failure")
+	// The next scan doesn't need to page back past the builds that were all processed
+	if store != nil && !stopped {
+		err = store.RecordHighWaterMark(highWaterMark(recentResults, stats.failures))
+		if err != nil {
+			fmt.Println("Failed to remember how far back the builds were processed:", err)
 		}
 	}
 
-	branchNamesToLastGoodCommitsString := mapToText(branchNamesToLastGoodCommits)
-	writeStringToFile("branchNamesToLastGoodCommits.txt", branchNamesToLastGoodCommitsString)
+	branchNamesToLastGoodCommitsString := mapToText(stats.branchNamesToLastGoodCommits)
 
 	elapsed := time.Since(scanStartTime)
 	fmt.Println("\nFinished scan at ", time.Now())
-	fmt.Println("Stats: ", "scanned =", counts["scanned"], ", skipped =", counts["skipped"], ", commented =", counts["commented"])
-	fmt.Println("Oldest build was ", maxHoursSincePublish, " hours ago; youngest build was ", minHoursSincePublish, " hours ago")
+	fmt.Println("Stats: ", "scanned =", stats.counts["scanned"], ", skipped =", stats.counts["skipped"], ", commented =", stats.counts["commented"], ", failed =", stats.counts["failed"])
+	fmt.Println("Oldest build was ", stats.maxHoursSincePublish, " hours ago; youngest build was ", stats.minHoursSincePublish, " hours ago")
 	fmt.Println("It took ", elapsed, " to run the scan")
 	fmt.Println("Branch names to commits:\n", branchNamesToLastGoodCommitsString)
+	return stats, nil
 }
 
-func mapToText(theMap map[string]string) string {
-	var result strings.Builder
-	for key, value := range theMap {
-		result.WriteString(key)
-		result.WriteString(" ")
-		result.WriteString(value)
-		result.WriteString("\n")
-	}
-	return result.String()
-}
+// Handle one build, printing everything about it at once so the output of concurrent builds isn't mixed up
+func handleAndReportBuild(recentResult RecentResult, bamboo Bamboo, rules *RulesFile, store *Store, integrations *Integrations, stats *scanStats) {
+	var output strings.Builder
+	output.WriteString("\n" + recentResult.Link + " : ")
+	stats.increment("scanned")
 
-func writeStringToFile(fileName string, text string) {
-	err := ioutil.WriteFile(fileName, []byte(text), 0644)
+	err := handleBuild(recentResult, bamboo, rules, store, integrations, stats, &output)
 	if err != nil {
-		panic(err)
+		fmt.Fprint(&output, "Failed: ", err)
+		stats.addFailure(BuildFailure{Link: recentResult.Link, Err: err})
 	}
+	fmt.Print(redact(output.String()))
 }
 
-func branchNameFromPlanName(planName string) (string, error) {
-	if planName == "Windows Official" {
-		return "develop", nil
-	} else if strings.HasPrefix(planName, "release-") {
-		return strings.Replace(planName, "release-", "release/", 1), nil
-	} else {
-		return "", errors.New("only release branches are supported for tagging")
+// Split the link to a build into its build key and build number, Ex: CRAB-CWS144 and 33. The link can be to the
+// result of a job (Ex: CRAB-CWS144-JOB1-33, as in the activity stream) or of the whole build (Ex: CRAB-CWS144-33,
+// as sent by the webhook).
+func parseBuildLink(link string) (string, string, error) {
+	splitBySlash := strings.Split(link, "/")
+	buildId := splitBySlash[len(splitBySlash)-1] // Ex: CRAB-CWS144-JOB1-33
+
+	splitByHyphen := strings.Split(buildId, "-")
+	if len(splitByHyphen) != 3 && len(splitByHyphen) != 4 {
+		return "", "", &BuildIdError{Link: link, BuildId: buildId}
 	}
-}
+	buildNumber := splitByHyphen[len(splitByHyphen)-1]
 
-type BambooResult struct {
-	XMLName        xml.Name `xml:"result"`
-	PlanName       string   `xml:"planName"`
-	VcsRevisionKey string   `xml:"vcsRevisionKey"`
-	BuildState     string   `xml:"buildState"`
+	// According to the REST API, "buildKey" usually refers to CWS144 in the example above.
+	// But in other contexts (URL query parameters) it's CRAB-CWS144.
+	buildKey := strings.Join(splitByHyphen[0:2], "-")
+	return buildKey, buildNumber, nil
 }
 
-func getBuildResult(bambooUrl string, buildKey string, buildNumber string, authHeader string, httpClient *http.Client) BambooResult {
-	getDetailsUrl := bambooUrl + "/rest/api/latest/result/" + buildKey + "/" + buildNumber + "?expand=artifacts&expand=changes&expand=results.result.artifacts&expand=results.result.labels&expand=results.result.comments&expand=results.result.jiraIssues&expand=changes.change&expand=changes.change.files&expand=metadata"
-	req, err := http.NewRequest("GET", getDetailsUrl, nil)
-	if err != nil {
-		panic(err)
-	}
-	req.Header.Add("Authorization", authHeader)
-	req.Header.Set("Content-Type", "application/xml")
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
+// Process one entry of the activity stream: scan it if it's a failure, and comment on what was found
+// What Bambot decides about the build is written to output.
+func handleBuild(recentResult RecentResult, bamboo Bamboo, rules *RulesFile, store *Store, integrations *Integrations, stats *scanStats, output io.Writer) error {
+	buildKey, buildNumber, err := parseBuildLink(recentResult.Link)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return handleBuildResult(recentResult, buildKey, buildNumber, bamboo, rules, store, integrations, stats, output)
+}
 
-	var parsedResult BambooResult
-	err = xml.Unmarshal(body, &parsedResult)
-	if err != nil {
-		panic(err)
-	}
+// The builds being handled, by build key and number, Ex: CRAB-CWS144-33
+var buildsInProgress = &buildLocks{locks: make(map[string]*buildLock)}
 
-	err = resp.Body.Close()
-	if err != nil {
-		panic(err)
+type buildLocks struct {
+	mutex sync.Mutex
+	locks map[string]*buildLock
+}
+
+type buildLock struct {
+	sync.Mutex
+	// How many are handling (or waiting to handle) the build, so the lock can be forgotten once there are none
+	holders int
+}
+
+// Wait until no one else is handling the build, and return the function that lets the next one handle it
+func (locks *buildLocks) lock(build string) func() {
+	locks.mutex.Lock()
+	lock, ok := locks.locks[build]
+	if !ok {
+		lock = &buildLock{}
+		locks.locks[build] = lock
+	}
+	lock.holders++
+	locks.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		locks.mutex.Lock()
+		defer locks.mutex.Unlock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(locks.locks, build)
+		}
 	}
-	return parsedResult
 }
 
-// Get the Bamboo labels on a build
-func getLabels(bambooUrl string, buildKey string, buildNumber string, jSessionId string, httpClient *http.Client) []string {
-	addLabelsUrl := bambooUrl + "/build/label/ajax/editLabels.action?buildNumber=" + buildNumber + "&buildKey=" + buildKey
-	req, err := http.NewRequest("GET", addLabelsUrl, nil)
-	if err != nil {
-		panic(err)
+// Process a build whose key and number are already known, Ex: CRAB-CWS144 and 33
+func handleBuildResult(recentResult RecentResult, buildKey string, buildNumber string, bamboo Bamboo, rules *RulesFile, store *Store, integrations *Integrations, stats *scanStats, output io.Writer) error {
+	publishedTime := recentResult.Published.Format(time.RFC3339)
+
+	skipScan := false
+	isSuccess := false
+	// Why a failed build was skipped, if that should be remembered
+	skipOutcome := ""
+
+	// Keep only failures
+	if recentResult.Successful {
+		fmt.Fprint(output, "Skipping: Successful build ... ")
+		skipScan = true
+		isSuccess = true
 	}
-	req.Header.Add("Cookie", "JSESSIONID="+jSessionId)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		panic(err)
+
+	record := BuildRecord{Build: buildKey + "-" + buildNumber, Link: recentResult.Link}
+
+	// The same build can arrive from the webhook while the activity stream is being scanned. Whichever comes second
+	// waits, and then finds the build already processed.
+	defer buildsInProgress.lock(record.Build)()
+
+	// Builds in the store have been processed already, so there's no need to ask Bamboo for their labels
+	if store != nil && !isSuccess {
+		previous, found, err := store.GetBuild(record.Build)
+		if err != nil {
+			return err
+		}
+		if found {
+			fmt.Fprint(output, "Skipping: Bambot already processed this build at ", previous.ProcessedAt.Format(time.RFC3339), " (", previous.Outcome, ") ... ")
+			stats.increment("skipped")
+			return nil
+		}
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+
+	// Read the existing labels on this failed build to find out if we've already processed it
+	var labels []string
+	if !isSuccess {
+		var err error
+		labels, err = bamboo.GetLabels(buildKey, buildNumber)
+		if err != nil {
+			return err
+		}
 	}
-	bodyStr := string(body)
-	err = resp.Body.Close()
-	if err != nil {
-		panic(err)
+
+	for _, label := range labels {
+		if label == "bambot-scanned" {
+			fmt.Fprint(output, "Skipping: Bambot already scanned ... ")
+			skipScan = true
+			skipOutcome = outcomeLabeled
+		} else if strings.HasPrefix(label, "crab-") {
+			fmt.Fprint(output, "Skipping: Already manually labeled ... ")
+			skipScan = true
+			skipOutcome = outcomeLabeled
+		}
 	}
 
-	re := regexp.MustCompile("data-label=\"([a-z0-9-]+)\"")
-	matches := re.FindAllStringSubmatch(bodyStr, -1)
+	if strings.Contains(recentResult.Content, "tests failed") {
+		// Skip this build, if Bamboo was able to parse the test failures we don't have any value to add
+		fmt.Fprint(output, "Skipping: Bamboo found test failures ... ")
+		skipScan = true
+		skipOutcome = outcomeTestsFailed
+	}
 
-	var labels []string
-	for _, match := range matches {
-		labels = append(labels, match[1])
+	timeSincePublish := time.Now().Sub(recentResult.Published)
+	hoursSincePublish := timeSincePublish.Hours()
+	stats.recordHoursSincePublish(hoursSincePublish)
+	if timeSincePublish > lookbackWindow {
+		fmt.Fprint(output, "Skipping: too old:", publishedTime, "...")
+		skipScan = true
 	}
-	return labels
-}
 
-// Add a Bamboo label to a build
-func addLabel(bambooUrl string, buildKey string, buildNumber string, label string, jSessionId string, httpClient *http.Client) []string {
-	addLabelsUrl := bambooUrl + "/build/label/ajax/addLabels.action"
-	reqBody := strings.NewReader(`buildKey=` + buildKey + `&buildNumber=` + buildNumber + `&labelInput=` + label)
-	req, err := http.NewRequest("POST", addLabelsUrl, reqBody)
-	if err != nil {
-		panic(err)
+	// Only the last good commits of the release plans are kept track of
+	if isSuccess && strings.Contains(buildKey, "CRAB-CWO") {
+		result, err := getResult(bamboo, recentResult, buildKey, buildNumber)
+		if err != nil {
+			return err
+		}
+		if result.BuildState == "Successful" {
+			stats.recordGoodCommit(result.PlanName, result.VcsRevisionKey, recentResult.Published)
+		}
 	}
-	req.Header.Add("Cookie", "JSESSIONID="+jSessionId)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		panic(err)
+
+	if skipScan {
+		stats.increment("skipped")
+		if skipOutcome != "" && !isSuccess {
+			record.Outcome = skipOutcome
+			return recordBuild(store, record)
+		}
+		return nil
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+
+	result, err := getResult(bamboo, recentResult, buildKey, buildNumber)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	bodyStr := string(body)
-	err = resp.Body.Close()
+	scanResult, err := scanBuild(bamboo, result, buildKey, buildNumber, rules)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	re := regexp.MustCompile("data-label=\"([a-z0-9-]+)\"")
-	matches := re.FindAllStringSubmatch(bodyStr, -1)
+	if scanResult.Matched() {
+		stats.increment("commented")
 
-	var labels []string
-	for _, match := range matches {
-		labels = append(labels, match[1])
+		scanResult.Occurrences, err = recordOccurrences(store, record.Build, recentResult, scanResult.Findings)
+		if err != nil {
+			return err
+		}
+		integrations.shareFindings(scanResult.Findings, recentResult.Link, scanResult.Occurrences, store, output)
+
+		commentContent := buildComment(scanResult)
+
+		if isDryRun(bamboo) {
+			fmt.Fprint(output, "Dry run, not adding comment & 'bambot-scanned' label:\n", commentContent, "\n")
+		} else {
+			fmt.Fprint(output, "Adding comment & 'bambot-scanned' label")
+		}
+		err = bamboo.AddComment(buildKey, buildNumber, commentContent)
+		if err != nil {
+			return err
+		}
+		err = bamboo.AddLabel(buildKey, buildNumber, "bambot-scanned")
+		if err != nil {
+			return err
+		}
+		if !isDryRun(bamboo) {
+			fmt.Fprint(output, " ... Sent a comment with length ", len(commentContent))
+		}
+		integrations.notify(buildKey, buildNumber, recentResult.Link, scanResult, output)
+		record.Outcome = outcomeCommented
+		record.Comment = commentContent
+	} else {
+		fmt.Fprint(output, "Couldn't find cause of failure")
+		record.Outcome = outcomeNoMatch
 	}
-	return labels
+	record.Findings = scanResult.Findings
+	return recordBuild(store, record)
 }
 
-func addCommentWithApi(bambooUrl string, buildKey string, buildNumber string, commentContent string, authHeader string, httpClient *http.Client) {
-	addCommentUrl := bambooUrl + "/rest/api/latest/result/" + buildKey + "-" + buildNumber + "/comment?os_authType=basic"
-	reqBody := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
-	<comment>
-		<content>` + escapeXmlString(commentContent) + `</content>
-	</comment>`
-	req, err := http.NewRequest("POST", addCommentUrl, strings.NewReader(reqBody))
-	if err != nil {
-		panic(err)
-	}
-	req.Header.Add("Authorization", authHeader)
-	req.Header.Set("Content-Type", "application/xml")
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	println("Sent a comment with length ", len(commentContent))
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+// The services Bambot tells about the failures it finds, besides Bamboo. Each of them is optional (nil).
+type Integrations struct {
+	jira  *jiraTracker
+	slack *slackNotifier
+}
+
+// Share the findings of a build with each integration, which might link them to issues.
+// A nil Integrations has nothing to share them with.
+func (integrations *Integrations) shareFindings(findings []Finding, link string, occurrences map[string]FingerprintRecord, store *Store, output io.Writer) {
+	if integrations == nil {
+		return
 	}
-	bodyStr := string(body)
-	err = resp.Body.Close()
-	println("After posting a comment, status was: ", resp.Status, ", body was: ", bodyStr)
-	if err != nil {
-		panic(err)
+	if integrations.jira != nil {
+		integrations.jira.linkFindings(findings, link, occurrences, store, output)
 	}
-	return
 }
 
-func escapeXmlString(s string) string {
-	b := new(bytes.Buffer)
-	err := xml.EscapeText(b, []byte(s))
-	if err != nil {
-		panic(err)
+// Tell people about a build whose failure was found, once it's been commented on.
+// A nil Integrations has no one to tell.
+func (integrations *Integrations) notify(buildKey string, buildNumber string, link string, scanResult ScanResult, output io.Writer) {
+	if integrations == nil {
+		return
+	}
+	if integrations.slack != nil {
+		integrations.slack.notify(buildKey, buildNumber, link, scanResult, output)
 	}
-	return b.String()
 }
 
-type ScanResult struct {
-	Comment     string
-	LogSnippet  string
-	JiraIssueId string
+// Remember which builds each finding has been found in, and return the records by fingerprint.
+// Without a store, each finding has only been found in this build.
+func recordOccurrences(store *Store, build string, recentResult RecentResult, findings []Finding) (map[string]FingerprintRecord, error) {
+	occurrences := make(map[string]FingerprintRecord)
+	for _, finding := range findings {
+		if store == nil {
+			record := FingerprintRecord{Fingerprint: finding.Fingerprint}
+			record.addOccurrence(build, recentResult.Link, recentResult.Published)
+			occurrences[finding.Fingerprint] = record
+			continue
+		}
+		record, err := store.RecordOccurrence(finding.Fingerprint, build, recentResult.Link, recentResult.Published)
+		if err != nil {
+			return nil, err
+		}
+		occurrences[finding.Fingerprint] = record
+	}
+	return occurrences, nil
 }
 
-func nonMatch() ScanResult {
-	return ScanResult{Comment: "", LogSnippet: "", JiraIssueId: ""}
+// Remember a processed build, if there's a store
+func recordBuild(store *Store, record BuildRecord) error {
+	if store == nil {
+		return nil
+	}
+	record.ProcessedAt = time.Now()
+	return store.RecordBuild(record)
 }
 
-// Investigate a build -- if it failed and the cause could be identified, return information about it!
-func scanBuild(bambooUrl string, buildKey string, buildNumber string, jSessionId string, httpClient *http.Client) ScanResult {
-	downloadLogsUrl := bambooUrl + "/download/" + buildKey + "-JOB1/build_logs/" + buildKey + "-JOB1-" + buildNumber + ".log?disposition=attachment"
-
-	// Download the logs!
-	req, err := http.NewRequest("GET", downloadLogsUrl, nil)
-	if err != nil {
-		panic(err)
+func mapToText(theMap map[string]string) string {
+	var result strings.Builder
+	for key, value := range theMap {
+		result.WriteString(key)
+		result.WriteString(" ")
+		result.WriteString(value)
+		result.WriteString("\n")
 	}
+	return result.String()
+}
 
-	req.Header.Add("Cookie", "JSESSIONID="+jSessionId)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	if resp.StatusCode != 200 {
-		fmt.Print("Failed to download logs from", downloadLogsUrl)
-		return nonMatch()
-	}
+func writeStringToFile(fileName string, text string) error {
+	return ioutil.WriteFile(fileName, []byte(text), 0644)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-	err = resp.Body.Close()
-	if err != nil {
-		panic(err)
+func branchNameFromPlanName(planName string) (string, error) {
+	if planName == "Windows Official" {
+		return "develop", nil
+	} else if strings.HasPrefix(planName, "release-") {
+		return strings.Replace(planName, "release-", "release/", 1), nil
+	} else {
+		return "", errors.New("only release branches are supported for tagging")
 	}
+}
 
-	bodyStr := string(body)
+// One possible cause of a build failure, found by a rule
+type Finding struct {
+	RuleName    string
+	Comment     string
+	LogSnippet  string
+	JiraIssueId string
+	// Where to read the JIRA issue, if Bambot found it in JIRA
+	JiraIssueLink string
+	Severity      string
+	// When the line that triggered the rule was logged, if known
+	Timestamp time.Time
+	// The job whose log contains the snippet, Ex: CRAB-CWS144-JOB1-33
+	Job     string
+	JobName string
+	// Identifies the same failure in other builds, Ex: 3f786850e387550f
+	Fingerprint string
+
+	// The range of log lines covered by the snippet
+	firstLine int
+	lastLine  int
+}
 
-	return scanString(bodyStr)
+type ScanResult struct {
+	Findings []Finding
+	// Every build each finding has been found in, by fingerprint, once they've been recorded
+	Occurrences map[string]FingerprintRecord
+	// The build the findings were found in, when it came from Bamboo
+	Build BambooResult
 }
 
-// Given a log file, determine if it matches one of the known patterns for build failures
-func scanString(bodyStr string) ScanResult {
-	start := "[ERROR] COMPILATION ERROR"
-	end := "[INFO] ------------------------------------------------------------------------"
-	context := getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a Java compilation error!", LogSnippet: context}
-	}
+func nonMatch() ScanResult {
+	return ScanResult{}
+}
 
-	start = "ERROR: Coverage for"
-	end = "with result: Failed"
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a Javascript coverage error!", LogSnippet: context}
-	}
+// Did any rule find a cause for the failure?
+func (scanResult ScanResult) Matched() bool {
+	return len(scanResult.Findings) > 0
+}
 
-	// C# build logs seem to spread the error details across a large number of lines.
-	// So, we have two patterns to try to catch the areas of interest.
-	start = "Errors and Failures:"
-	end = "Error(s)"
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a C# build error!", LogSnippet: context}
+// Build the text of the Bamboo comment summarizing everything that was found
+func buildComment(scanResult ScanResult) string {
+	commentContent := ""
+	if len(scanResult.Findings) > 1 {
+		commentContent += fmt.Sprintf("Bambot found %d possible causes of this failure:\n\n", len(scanResult.Findings))
 	}
-
-	start = "Build FAILED."
-	end = "Error(s)"
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a C# build failure!", LogSnippet: context}
+	for idx, finding := range scanResult.Findings {
+		if len(scanResult.Findings) > 1 {
+			commentContent += fmt.Sprintf("%d. [%s] ", idx+1, finding.Severity)
+		}
+		commentContent += finding.Comment + "\n\n"
+		if finding.Job != "" {
+			commentContent += "In job " + finding.JobName + " (" + finding.Job + ")\n\n"
+		}
+		if !finding.Timestamp.IsZero() {
+			commentContent += "Logged at " + finding.Timestamp.Format(logTimestampFormat) + "\n\n"
+		}
+		if finding.JiraIssueId != "" {
+			commentContent += "This is a known issue in JIRA: " + finding.JiraIssueId
+			if finding.JiraIssueLink != "" {
+				commentContent += " (" + finding.JiraIssueLink + ")"
+			}
+			commentContent += "\n\n"
+		}
+		if record, found := scanResult.Occurrences[finding.Fingerprint]; found && len(record.Builds) > 1 {
+			commentContent += describeOccurrences(record) + "\n\n"
+		}
+		commentContent += "Log snippet:\n" + finding.LogSnippet
+		if idx < len(scanResult.Findings)-1 {
+			commentContent += "\n\n"
+		}
 	}
+	return commentContent
+}
 
-	start = "[WARNING] Rule violated for bundle"
-	end = "Coverage checks have not been met. See log for details."
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected Java code coverage was below the required threshold!", LogSnippet: context}
+// Ex: Seen 14 times across 6 plans since 07-Jan-2020, first in https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33
+func describeOccurrences(record FingerprintRecord) string {
+	plans := "across " + strconv.Itoa(record.plans()) + " plans"
+	if record.plans() == 1 {
+		plans = "in 1 plan"
 	}
-
-	start = "[INFO] BUILD FAILURE"
-	end = "with result: Failed"
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a Maven (Java build system) error!", LogSnippet: context}
+	text := fmt.Sprintf("Seen %d times %s since %s", len(record.Builds), plans, record.FirstSeen.Format(occurrenceDateFormat))
+	if record.FirstLink != "" {
+		text += ", first in " + record.FirstLink
 	}
+	return text
+}
 
-	start = "***** ERROR *****"
-	end = "with result: Failed"
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected an error!", LogSnippet: context}
+// The result of a build, unless it's already been fetched
+func getResult(bamboo Bamboo, recentResult RecentResult, buildKey string, buildNumber string) (BambooResult, error) {
+	if recentResult.Result != nil {
+		return *recentResult.Result, nil
 	}
+	return bamboo.GetResult(buildKey, buildNumber)
+}
 
-	start = "=================================== FAILURES ==================================="
-	end = "with result: Failed"
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a Python pytest error!", LogSnippet: context}
-	}
+// Investigate a build -- if it failed and the cause could be identified, return information about it!
+// The log of every failed job in the build is scanned, and each finding records the job it came from.
+func scanBuild(bamboo Bamboo, result BambooResult, buildKey string, buildNumber string, rules *RulesFile) (ScanResult, error) {
+	jobs := result.failedJobs()
+	if len(jobs) == 0 {
+		// Without any details about the stages, the first job is the best guess
+		var job BambooJobResult
+		job.Key = buildKey + "-JOB1-" + buildNumber
+		jobs = append(jobs, job)
+	}
+
+	scanResult := ScanResult{Build: result}
+	for _, job := range jobs {
+		jobLog, err := bamboo.DownloadJobLog(job)
+		if err != nil {
+			return scanResult, err
+		}
 
-	start = "Seeq Build Step: Building with Grunt"
-	end = "Aborted due to warnings."
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a front-end Grunt build error!", LogSnippet: context}
+		// Logs can be hundreds of megabytes, so scan them as they're downloaded
+		jobScanResult, err := scanReader(jobLog, rules)
+		closeErr := jobLog.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return scanResult, &RequestError{Service: bambooService, Operation: "download logs", Url: job.Key, Err: err}
+		}
+		for _, finding := range jobScanResult.Findings {
+			finding.Job = job.Key
+			finding.JobName = job.name()
+			scanResult.Findings = append(scanResult.Findings, finding)
+		}
 	}
+	return scanResult, nil
+}
 
-	start = "Errors and Failures:"
-	end = "Committing..."
-	context = getSubstring(bodyStr, start, end)
-	if len(context) > 0 {
-		return ScanResult{Comment: "Bambot detected a C# unit test/integration test failure!", LogSnippet: context}
+// Given a log file, find every known pattern of build failure it matches.
+// Findings are listed in the order of the rules that found them.
+// Rules match against the log messages, ignoring the prefix Bamboo adds to each line.
+// Secrets in the snippets are scrubbed, and known issues are linked.
+func scanString(bodyStr string, rules *RulesFile) ScanResult {
+	lines := parseLog(bodyStr)
+	var findings []Finding
+	for _, rule := range rules.Rules {
+		if finding, ok := rule.match(lines); ok {
+			findings = append(findings, finding)
+		}
 	}
-
-	return nonMatch()
+	return ScanResult{Findings: rules.finishFindings(removeOverlappingFindings(findings))}
 }
 
-// Get a portion of a string based on a start pattern and end pattern. The result will include both start & end.
-// If no result is found, an empty string will be returned.
-func getSubstring(input string, start string, end string) string {
-	endIndex := strings.LastIndex(input, end)
-	if endIndex >= 0 {
-		beforeEnd := input[:endIndex]
-		startIndex := strings.LastIndex(beforeEnd, start)
-
-		if startIndex >= 0 {
-			fullSnippet := beforeEnd[startIndex:]
-
-			// In case the snippet is huge in either dimension, truncate it
-			snippet := truncateLines(fullSnippet, 160, 2000)
-			return snippet
+// Several rules often match the same part of a log (e.g. the C# rules), which would only repeat the same snippet.
+// Drop any finding whose snippet lies entirely within the snippet of a finding that comes before it.
+func removeOverlappingFindings(findings []Finding) []Finding {
+	var result []Finding
+	for _, finding := range findings {
+		overlaps := false
+		for _, kept := range result {
+			if kept.firstLine <= finding.firstLine && finding.lastLine <= kept.lastLine {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			result = append(result, finding)
 		}
 	}
-	return ""
+	return result
 }
 
 // Given a multi-line string, truncate each line to be no wider than maxWidth,
@@ -577,12 +845,7 @@ func truncateLines(bodyStr string, maxWidth int, maxLines int) string {
 
 	var result strings.Builder
 	for idx, line := range lines {
-		if len(line) > maxWidth {
-			result.WriteString(line[0 : maxWidth-3])
-			result.WriteString("...")
-		} else {
-			result.WriteString(line)
-		}
+		result.WriteString(truncateLine(line, maxWidth))
 		if idx < len(lines)-1 {
 			result.WriteString("\n")
 		}
@@ -592,3 +855,11 @@ func truncateLines(bodyStr string, maxWidth int, maxLines int) string {
 	}
 	return result.String()
 }
+
+// Truncate a single line to be no wider than maxWidth, adding an ellipsis (...) if it was truncated
+func truncateLine(line string, maxWidth int) string {
+	if len(line) > maxWidth {
+		return line[0:maxWidth-3] + "..."
+	}
+	return line
+}
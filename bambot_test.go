@@ -1,11 +1,17 @@
 package main
 
 import (
+    "encoding/xml"
+    "fmt"
     "io/ioutil"
     "strings"
     "testing"
+    "time"
 )
 
+// The shipped rules, with the known issues from a test-only file
+var testRules = mustLoadTestRules()
+
 func TestTruncateLines(t *testing.T) {
     str := "12345678\nABCDEFGH\nX\n\n"
 
@@ -77,12 +83,134 @@ func TestCSharpTestError(t *testing.T) {
     assertMatch(t, bodyStr, "Bambot detected a C# unit test/integration test failure!")
 }
 
+func TestCSharpCompilerError(t *testing.T) {
+    fileName := "test_files/csharp-compiler-error.log"
+    bodyStr := readFileToString(fileName)
+    scanResult := assertMatch(t, bodyStr, "Bambot detected a C# compiler error (CS0103)!")
+    assertContains(t, scanResult.LogSnippet, "(default target) (1) ->")
+    assertContains(t, scanResult.LogSnippet, "0 Warning(s)")
+    assertNotContains(t, scanResult.LogSnippet, "Build FAILED.")
+}
+
 func TestPyTestError(t *testing.T) {
     fileName := "test_files/python-pytest.log"
     bodyStr := readFileToString(fileName)
     assertMatch(t, bodyStr, "Bambot detected a Python pytest error!")
 }
 
+// A log with several distinct failures should report all of them, in rule priority order
+func TestMultipleFailureCauses(t *testing.T) {
+    bodyStr := readFileToString("test_files/csharp-compiler-error.log") + readFileToString("test_files/python-pytest.log")
+    scanResult := scanString(bodyStr, testRules)
+    if len(scanResult.Findings) != 3 {
+        t.Fatalf("expected 3 findings but found %d: %v", len(scanResult.Findings), scanResult.Findings)
+    }
+    assertEquals(t, scanResult.Findings[0].RuleName, "csharp-compiler-error")
+    assertEquals(t, scanResult.Findings[1].RuleName, "csharp-build-failure")
+    assertEquals(t, scanResult.Findings[2].RuleName, "python-pytest")
+
+    comment := buildComment(scanResult)
+    assertContains(t, comment, "Bambot found 3 possible causes of this failure:")
+    assertContains(t, comment, "1. [error] Bambot detected a C# compiler error (CS0103)!")
+    assertContains(t, comment, "3. [error] Bambot detected a Python pytest error!")
+}
+
+// Rules matching the same part of the log shouldn't repeat the same snippet
+func TestOverlappingFindingsAreRemoved(t *testing.T) {
+    scanResult := scanString(readFileToString("test_files/csharp-1.log"), testRules)
+    if len(scanResult.Findings) != 1 {
+        t.Fatalf("expected 1 finding but found %d: %v", len(scanResult.Findings), scanResult.Findings)
+    }
+    // The snippet includes the known DefaultConcurrentRequestsHandlerTest timeout
+    assertEquals(t, buildComment(scanResult), "Bambot detected a C# build error!\n\nLogged at 07-Jan-2020 07:31:47\n\n" +
+        "This is a known issue in JIRA: CRAB-1234\n\nLog snippet:\n" + scanResult.Findings[0].LogSnippet)
+}
+
+func TestFailedJobs(t *testing.T) {
+    var result BambooResult
+    err := xml.Unmarshal([]byte(readFileToString("test_files/result-multiple-jobs.xml")), &result)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, result.PlanName, "feature-branch-144")
+    assertEquals(t, result.BuildState, "Failed")
+
+    jobs := result.failedJobs()
+    if len(jobs) != 2 {
+        t.Fatalf("expected 2 failed jobs but found %d", len(jobs))
+    }
+    assertEquals(t, jobs[0].Key, "CRAB-CWS144-JOB2-33")
+    assertEquals(t, jobs[0].jobKey(), "CRAB-CWS144-JOB2")
+    assertEquals(t, jobs[0].name(), ".NET")
+    assertEquals(t, jobs[1].Key, "CRAB-CWS144-PYTEST-33")
+    assertEquals(t, jobs[1].jobKey(), "CRAB-CWS144-PYTEST")
+
+    // Without the details from the plan, the job key comes from the job result key
+    var job BambooJobResult
+    job.Key = "CRAB-CWS144-JOB1-33"
+    assertEquals(t, job.jobKey(), "CRAB-CWS144-JOB1")
+    assertEquals(t, job.name(), "CRAB-CWS144-JOB1")
+}
+
+func TestCommentAttributesFindingsToJobs(t *testing.T) {
+    scanResult := ScanResult{Findings: []Finding{
+        {Comment: "First!", LogSnippet: "one", Severity: "error", Job: "CRAB-CWS144-JOB2-33", JobName: ".NET"},
+        {Comment: "Second!", LogSnippet: "two", Severity: "warning", Job: "CRAB-CWS144-PYTEST-33", JobName: "Python tests"},
+    }}
+    assertEquals(t, buildComment(scanResult), "Bambot found 2 possible causes of this failure:\n\n" +
+        "1. [error] First!\n\nIn job .NET (CRAB-CWS144-JOB2-33)\n\nLog snippet:\none\n\n" +
+        "2. [warning] Second!\n\nIn job Python tests (CRAB-CWS144-PYTEST-33)\n\nLog snippet:\ntwo")
+}
+
+func TestCommentSaysHowOftenAFailureWasSeen(t *testing.T) {
+    scanResult := ScanResult{
+        Findings: []Finding{{Comment: "First!", LogSnippet: "one", Fingerprint: "3f786850e387550f"}},
+        Occurrences: map[string]FingerprintRecord{"3f786850e387550f": {
+            Builds:    []string{"CRAB-CWS144-33", "CRAB-CWS145-7", "CRAB-CWS144-34"},
+            FirstSeen: time.Date(2020, 1, 7, 7, 31, 47, 0, time.UTC),
+            FirstLink: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33",
+        }},
+    }
+    assertEquals(t, buildComment(scanResult), "First!\n\n" +
+        "Seen 3 times across 2 plans since 07-Jan-2020, first in https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33\n\n" +
+        "Log snippet:\none")
+
+    // The first time a failure is seen, there's nothing to say
+    scanResult.Occurrences["3f786850e387550f"] = FingerprintRecord{Builds: []string{"CRAB-CWS144-33"}}
+    assertEquals(t, buildComment(scanResult), "First!\n\nLog snippet:\none")
+}
+
+func TestParseBuildLink(t *testing.T) {
+    buildKey, buildNumber, err := parseBuildLink("https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33")
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, buildKey, "CRAB-CWS144")
+    assertEquals(t, buildNumber, "33")
+
+    // The REST API lists the results of whole builds
+    buildKey, buildNumber, err = parseBuildLink("https://bamboo.example.com/browse/CRAB-CWS144-33")
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, buildKey, "CRAB-CWS144")
+    assertEquals(t, buildNumber, "33")
+
+    _, _, err = parseBuildLink("https://bamboo.example.com/browse/CRAB-33")
+    if _, ok := err.(*BuildIdError); !ok {
+        t.Errorf("expected a BuildIdError but got '%v'", err)
+    }
+}
+
+func TestRequestErrorMessage(t *testing.T) {
+    err := &RequestError{Service: bambooService, Operation: "get labels", Url: "https://bamboo.example.com/labels", StatusCode: 503, Message: "Service Unavailable"}
+    assertEquals(t, err.Error(), "failed to get labels (https://bamboo.example.com/labels): status code 503: Service Unavailable")
+
+    // Only Bamboo has a session to log in to again
+    assertEquals(t, fmt.Sprint(isSessionExpired(&RequestError{Service: bambooService, StatusCode: 401})), "true")
+    assertEquals(t, fmt.Sprint(isSessionExpired(&RequestError{Service: jiraService, StatusCode: 401})), "false")
+}
+
 func assertEquals(t *testing.T, str string, expectedStr string) string {
     if str != expectedStr {
         t.Errorf("expected '%s' but got '%s'", expectedStr, str)
@@ -105,22 +233,38 @@ func assertNotContains(t *testing.T, str string, subStr string) string {
 }
 
 func assertNonMatch(t *testing.T, bodyStr string) ScanResult {
-    scanResult := scanString(bodyStr)
-    if scanResult != nonMatch() {
-       t.Errorf("expected '%s' to not match any rules, result was '%s'", bodyStr, scanResult)
+    scanResult := scanString(bodyStr, testRules)
+    if scanResult.Matched() {
+       t.Errorf("expected '%s' to not match any rules, result was '%v'", bodyStr, scanResult)
     }
     return scanResult
 }
 
-func assertMatch(t *testing.T, bodyStr string, expectedComment string) ScanResult {
-    scanResult := scanString(bodyStr)
-    if scanResult == nonMatch() {
+// Assert that the first (highest priority) finding has the expected comment
+func assertMatch(t *testing.T, bodyStr string, expectedComment string) Finding {
+    scanResult := scanString(bodyStr, testRules)
+    if !scanResult.Matched() {
         t.Errorf("expected '%s' to match a rule, but it matched nothing", truncate(bodyStr))
+        return Finding{}
     }
-    if scanResult.Comment != expectedComment {
-        t.Errorf("expected comment '%s' but found '%s'", expectedComment, scanResult.Comment)
+    if scanResult.Findings[0].Comment != expectedComment {
+        t.Errorf("expected comment '%s' but found '%s'", expectedComment, scanResult.Findings[0].Comment)
     }
-    return scanResult
+    return scanResult.Findings[0]
+}
+
+func mustLoadRules(fileName string) *RulesFile {
+    rules, err := loadRules(fileName)
+    if err != nil {
+        panic(err)
+    }
+    return rules
+}
+
+func mustLoadTestRules() *RulesFile {
+    rules := mustLoadRules(defaultRulesFile)
+    rules.KnownIssues = append(rules.KnownIssues, mustLoadRules("test_files/known-issues.json").KnownIssues...)
+    return rules
 }
 
 func truncate(bodyStr string) string {
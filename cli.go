@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage:
+  bambot [run] [-rules file] [-dry-run] [-report file] [-store file] [-workers n] [-max-requests-per-host n]
+               [-timeout duration] [-retries n] [-requests-per-second n] [-jira-create-after n]
+        Scan the recent builds in Bamboo, and comment on the ones that failed.
+        Needs the BAMBOO_URL environment variable, and BAMBOO_TOKEN or BAMBOO_USERNAME and BAMBOO_PASSWORD.
+        With JIRA_URL and JIRA_TOKEN, also links the failures to open JIRA issues.
+        With BAMBOT_SLACK_WEBHOOK_URL (or a webhook for each Slack route), also posts the failures to Slack.
+  bambot serve [-rules file] [-store file] [-interval duration] [-jitter duration] [-listen address]
+               [-workers n] [-max-requests-per-host n] [-timeout duration] [-retries n] [-requests-per-second n]
+               [-jira-create-after n]
+        Keep scanning the recent builds in Bamboo, every 5 minutes by default, until stopped with SIGTERM.
+        With -listen, also scan the builds Bamboo sends to /webhook (needs BAMBOT_WEBHOOK_SECRET).
+        Needs the same environment variables as run.
+  bambot scan [-rules file] [-format text|json] <file|->
+        Scan a build log (or - for stdin), and print what Bambot would say about it.
+        Exits with 0 if a cause of failure was found, 1 if not, and 2 if the log couldn't be scanned.
+  bambot history [-store file] [-format text|json] <build>
+        Print what Bambot said about a build, Ex: CRAB-CWS144-33 or a link to the build.
+        Exits with 0 if Bambot processed the build, 1 if not, and 2 if the store couldn't be read.
+  bambot help
+        Print this message.
+`
+
+// How Bambot signs in to Bamboo: with a personal access token, or else a username and password
+type credentials struct {
+	bambooUrl string
+	username  string
+	password  string
+	token     string
+}
+
+// The Bamboo server, and either a token or a username and password. Each of them can be in an environment variable,
+// or in a file named by the variable with _FILE on the end. The username and password can also be in a netrc file.
+// Exits if any of them are missing.
+func credentialsFromEnv() credentials {
+	bambooUrl, exists := os.LookupEnv("BAMBOO_URL")
+	if !exists {
+		exitWithError("Missing BAMBOO_URL environment variable")
+	}
+	token := secretFromEnvOrExit("BAMBOO_TOKEN")
+	if token != "" {
+		addSecretOrExit("BAMBOO_TOKEN", token)
+		return credentials{bambooUrl: bambooUrl, token: token}
+	}
+
+	username := secretFromEnvOrExit("BAMBOO_USERNAME")
+	password := secretFromEnvOrExit("BAMBOO_PASSWORD")
+	if username == "" || password == "" {
+		if netrcFile := netrcFileFromEnv(); netrcFile != "" {
+			parsedUrl, err := url.Parse(bambooUrl)
+			if err != nil {
+				exitWithError("Invalid BAMBOO_URL environment variable: " + err.Error())
+			}
+			login, netrcPassword, found, err := readNetrc(netrcFile, parsedUrl.Hostname())
+			if err != nil {
+				exitWithError("Failed to read " + netrcFile + ": " + err.Error())
+			}
+			if found && username == "" {
+				username = login
+			}
+			if found && password == "" {
+				password = netrcPassword
+			}
+		}
+	}
+	if username == "" {
+		exitWithError("Missing BAMBOO_TOKEN, or BAMBOO_USERNAME and BAMBOO_PASSWORD environment variables")
+	}
+	if password == "" {
+		exitWithError("Missing BAMBOO_PASSWORD environment variable")
+	}
+	addSecretOrExit("The Bamboo password", password)
+	addSecret(strings.TrimPrefix(buildAuthorizationHeader(username, password), "Basic "))
+	return credentials{bambooUrl: bambooUrl, username: username, password: password}
+}
+
+// The JIRA integration, if JIRA_URL is set. JIRA_TOKEN is sent as a personal access token, or with JIRA_USERNAME,
+// as the password of HTTP Basic authentication (as JIRA Cloud's API tokens are). Exits if anything is missing.
+func jiraTrackerFromEnv(createAfter int, dryRun bool, httpOptions *httpOptions) *jiraTracker {
+	jiraUrl, exists := os.LookupEnv("JIRA_URL")
+	if !exists {
+		return nil
+	}
+	token := secretFromEnvOrExit("JIRA_TOKEN")
+	if token == "" {
+		exitWithError("Missing JIRA_TOKEN environment variable, which is needed with JIRA_URL")
+	}
+	addSecretOrExit("JIRA_TOKEN", token)
+	authHeader := "Bearer " + token
+	if username := secretFromEnvOrExit("JIRA_USERNAME"); username != "" {
+		authHeader = buildAuthorizationHeader(username, token)
+		addSecret(strings.TrimPrefix(authHeader, "Basic "))
+	}
+
+	project := os.Getenv("JIRA_PROJECT")
+	if createAfter > 0 && project == "" {
+		exitWithError("Missing JIRA_PROJECT environment variable, which is needed to file JIRA issues")
+	}
+	issueType := defaultJiraIssueType
+	if value, exists := os.LookupEnv("BAMBOT_JIRA_ISSUE_TYPE"); exists {
+		issueType = value
+	}
+	client := newJiraClient(strings.TrimRight(jiraUrl, "/"), newHttpClient(httpOptions), authHeader)
+	return newJiraTracker(client, project, issueType, createAfter, dryRun)
+}
+
+// The Slack notifications, if BAMBOT_SLACK_WEBHOOK_URL or a route's webhook is set. The URLs are secrets, so they
+// can be read from files too. Exits if a route's webhook isn't set.
+func slackNotifierFromEnv(routing SlackRouting, dryRun bool, httpOptions *httpOptions) *slackNotifier {
+	webhookUrls := make(map[string]string)
+	if webhookUrl := secretFromEnvOrExit(slackWebhookEnv("")); webhookUrl != "" {
+		webhookUrls[""] = webhookUrl
+	}
+	for _, route := range routing.Routes {
+		webhookUrl := secretFromEnvOrExit(slackWebhookEnv(route.Webhook))
+		if webhookUrl == "" {
+			exitWithError("Missing " + slackWebhookEnv(route.Webhook) + " environment variable, which is needed for the Slack route for " + route.Plan)
+		}
+		webhookUrls[route.Webhook] = webhookUrl
+	}
+	if len(webhookUrls) == 0 {
+		return nil
+	}
+	for _, webhookUrl := range webhookUrls {
+		addSecret(webhookUrl)
+	}
+	return newSlackNotifier(webhookUrls, newHttpClient(httpOptions), routing, dryRun)
+}
+
+// A secret from the environment or a file, or "" if there's neither. Exits if the file can't be read.
+func secretFromEnvOrExit(name string) string {
+	value, _, err := secretFromEnv(name)
+	if err != nil {
+		exitWithError("Failed to read " + name + "_FILE: " + err.Error())
+	}
+	return value
+}
+
+// Remember a secret, so it's redacted from everything Bambot prints. Exits if it's too short to be redacted.
+func addSecretOrExit(name string, secret string) {
+	if err := checkSecretLength(name, secret); err != nil {
+		exitWithError(err.Error())
+	}
+	addSecret(secret)
+}
+
+// With a token there's nothing to log in to
+func (creds credentials) logIn(client *BambooClient) error {
+	if creds.token != "" {
+		client.UseToken(creds.token)
+		return nil
+	}
+	return client.LogIn(creds.username, creds.password)
+}
+
+// Bamboo's redirects (Ex: to the login page) mean something, so they aren't followed
+func newHttpClient(options *httpOptions) *http.Client {
+	return &http.Client{
+		Transport: options.transport(http.DefaultTransport),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func rulesFileFromEnv() string {
+	if rulesFile, exists := os.LookupEnv("BAMBOT_RULES_FILE"); exists {
+		return rulesFile
+	}
+	return defaultRulesFile
+}
+
+func storeFileFromEnv() string {
+	if storeFile, exists := os.LookupEnv("BAMBOT_STORE_FILE"); exists {
+		return storeFile
+	}
+	return defaultStoreFile
+}
+
+func intFromEnv(name string, defaultValue int) int {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		exitWithError("Invalid " + name + " environment variable: " + err.Error())
+	}
+	return number
+}
+
+func floatFromEnv(name string, defaultValue float64) float64 {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return defaultValue
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		exitWithError("Invalid " + name + " environment variable: " + err.Error())
+	}
+	return number
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		exitWithError("Invalid " + name + " environment variable: " + err.Error())
+	}
+	return duration
+}
+
+func isTrue(value string) bool {
+	value = strings.ToLower(value)
+	return value == "true" || value == "1" || value == "yes"
+}
+
+func exitWithError(message string) {
+	fmt.Fprintln(os.Stderr, redact(message))
+	os.Exit(1)
+}
+
+// How a finding is printed by the scan command
+type findingOutput struct {
+	Rule        string `json:"rule"`
+	Severity    string `json:"severity"`
+	Comment     string `json:"comment"`
+	JiraIssueId string `json:"jiraIssueId,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Snippet     string `json:"snippet"`
+}
+
+// Scan a local log file, without talking to Bamboo. Returns the exit code.
+func scanCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rulesFile := flags.String("rules", rulesFileFromEnv(), "the rules file")
+	format := flags.String("format", "text", "the output format: text or json")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	rules, err := loadRules(*rulesFile)
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to load rules from "+*rulesFile+": "+err.Error())
+		return 2
+	}
+
+	fileName := flags.Arg(0)
+	log := stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		defer file.Close()
+		log = file
+	}
+
+	scanResult, err := scanReader(log, rules)
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to read "+fileName+": "+err.Error())
+		return 2
+	}
+
+	outputs := toFindingOutputs(scanResult.Findings)
+	if *format == "json" {
+		err = printJson(stdout, outputs)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	} else {
+		printFindings(stdout, outputs)
+	}
+
+	if !scanResult.Matched() {
+		return 1
+	}
+	return 0
+}
+
+func toFindingOutputs(findings []Finding) []findingOutput {
+	outputs := make([]findingOutput, 0, len(findings))
+	for _, finding := range findings {
+		output := findingOutput{
+			Rule:        finding.RuleName,
+			Severity:    finding.Severity,
+			Comment:     finding.Comment,
+			JiraIssueId: finding.JiraIssueId,
+			Fingerprint: finding.Fingerprint,
+			Snippet:     finding.LogSnippet,
+		}
+		if !finding.Timestamp.IsZero() {
+			output.Timestamp = finding.Timestamp.Format(logTimestampFormat)
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+func printJson(stdout io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func printFindings(stdout io.Writer, outputs []findingOutput) {
+	if len(outputs) == 0 {
+		fmt.Fprintln(stdout, "Bambot couldn't find the cause of the failure.")
+		return
+	}
+	for idx, output := range outputs {
+		if idx > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "Rule: %s (%s)\n", output.Rule, output.Severity)
+		fmt.Fprintf(stdout, "Comment: %s\n", output.Comment)
+		if output.JiraIssueId != "" {
+			fmt.Fprintf(stdout, "JIRA: %s\n", output.JiraIssueId)
+		}
+		if output.Timestamp != "" {
+			fmt.Fprintf(stdout, "Logged at: %s\n", output.Timestamp)
+		}
+		fmt.Fprintf(stdout, "Fingerprint: %s\n", output.Fingerprint)
+		fmt.Fprintf(stdout, "Log snippet:\n%s\n", output.Snippet)
+	}
+}
+
+// How a build is printed by the history command
+type historyOutput struct {
+	Build       string          `json:"build"`
+	Link        string          `json:"link"`
+	ProcessedAt string          `json:"processedAt"`
+	Outcome     string          `json:"outcome"`
+	Comment     string          `json:"comment,omitempty"`
+	Findings    []findingOutput `json:"findings"`
+}
+
+// Look up what Bambot did with a build, without talking to Bamboo. Returns the exit code.
+func historyCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	storeFile := flags.String("store", storeFileFromEnv(), "the file where Bambot remembers the builds it has processed")
+	format := flags.String("format", "text", "the output format: text or json")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	build, err := parseBuildArg(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if _, err := os.Stat(*storeFile); os.IsNotExist(err) {
+		fmt.Fprintln(stdout, "Bambot hasn't processed any builds yet ("+*storeFile+" doesn't exist).")
+		return 1
+	}
+	store, err := openStoreReadOnly(*storeFile)
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to open the store "+*storeFile+": "+err.Error())
+		return 2
+	}
+	defer store.Close()
+
+	record, found, err := store.GetBuild(build)
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to read "+build+" from the store: "+err.Error())
+		return 2
+	}
+	if !found {
+		fmt.Fprintln(stdout, "Bambot hasn't processed "+build+".")
+		return 1
+	}
+
+	output := historyOutput{
+		Build:       record.Build,
+		Link:        record.Link,
+		ProcessedAt: record.ProcessedAt.Format(time.RFC3339),
+		Outcome:     record.Outcome,
+		Comment:     record.Comment,
+		Findings:    toFindingOutputs(record.Findings),
+	}
+	if *format == "json" {
+		err = printJson(stdout, output)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Build: %s (%s)\n", output.Build, output.Link)
+	fmt.Fprintf(stdout, "Processed at: %s\n", output.ProcessedAt)
+	fmt.Fprintf(stdout, "Outcome: %s\n", output.Outcome)
+	if output.Comment != "" {
+		fmt.Fprintf(stdout, "Comment:\n%s\n", output.Comment)
+	}
+	return 0
+}
+
+// A build can be given as a link, a job result key (Ex: CRAB-CWS144-JOB1-33), or a build key and number
+// (Ex: CRAB-CWS144-33). Returns the build key and number.
+func parseBuildArg(arg string) (string, error) {
+	if strings.Contains(arg, "/") {
+		buildKey, buildNumber, err := parseBuildLink(arg)
+		if err != nil {
+			return "", err
+		}
+		return buildKey + "-" + buildNumber, nil
+	}
+
+	splitByHyphen := strings.Split(arg, "-")
+	switch len(splitByHyphen) {
+	case 3:
+		return arg, nil
+	case 4:
+		return strings.Join(splitByHyphen[0:2], "-") + "-" + splitByHyphen[3], nil
+	default:
+		return "", &BuildIdError{Link: arg, BuildId: arg}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestScanCommand(t *testing.T) {
+    var stdout, stderr bytes.Buffer
+    exitCode := scanCommand([]string{"test_files/generic.log"}, nil, &stdout, &stderr)
+    if exitCode != 0 {
+        t.Fatalf("expected exit code 0 but got %d: %s", exitCode, stderr.String())
+    }
+    assertContains(t, stdout.String(), "Rule: generic-error (error)")
+    assertContains(t, stdout.String(), "Comment: Bambot detected an error!")
+    assertContains(t, stdout.String(), "Logged at: 02-Jan-2020 17:51:16")
+    assertContains(t, stdout.String(), "Timed out waiting for Seeq Server to become responsive.")
+}
+
+func TestScanCommandJsonFromStdin(t *testing.T) {
+    var stdout, stderr bytes.Buffer
+    stdin := strings.NewReader(readFileToString("test_files/csharp-compiler-error.log"))
+    exitCode := scanCommand([]string{"-format", "json", "-"}, stdin, &stdout, &stderr)
+    if exitCode != 0 {
+        t.Fatalf("expected exit code 0 but got %d: %s", exitCode, stderr.String())
+    }
+
+    var outputs []findingOutput
+    err := json.Unmarshal(stdout.Bytes(), &outputs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, outputs[0].Rule, "csharp-compiler-error")
+    assertEquals(t, outputs[0].Comment, "Bambot detected a C# compiler error (CS0103)!")
+    assertContains(t, outputs[0].Snippet, "error CS0103")
+}
+
+func TestScanCommandWithoutMatch(t *testing.T) {
+    var stdout, stderr bytes.Buffer
+    exitCode := scanCommand([]string{"-format", "json", "-"}, strings.NewReader("all good\n"), &stdout, &stderr)
+    if exitCode != 1 {
+        t.Errorf("expected exit code 1 but got %d", exitCode)
+    }
+    assertEquals(t, strings.TrimSpace(stdout.String()), "[]")
+}
+
+func TestScanCommandErrors(t *testing.T) {
+    for _, args := range [][]string{
+        {},
+        {"test_files/does-not-exist.log"},
+        {"-format", "xml", "test_files/generic.log"},
+        {"-rules", "does-not-exist.json", "test_files/generic.log"},
+        {"-no-such-flag", "test_files/generic.log"},
+    } {
+        var stdout, stderr bytes.Buffer
+        exitCode := scanCommand(args, nil, &stdout, &stderr)
+        if exitCode != 2 {
+            t.Errorf("expected exit code 2 for %v but got %d", args, exitCode)
+        }
+    }
+}
+
+func TestHistoryCommand(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = store.RecordBuild(BuildRecord{
+        Build:       "CRAB-CWS144-33",
+        Link:        "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33",
+        ProcessedAt: time.Date(2020, 1, 7, 7, 31, 47, 0, time.UTC),
+        Outcome:     outcomeCommented,
+        Findings:    []Finding{{RuleName: "generic-error", Severity: "error", Comment: "Bambot detected an error!"}},
+        Comment:     "Bambot detected an error!\n\nLog snippet:\nTimed out",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = store.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The build can be given by its key and number, its job result key, or a link
+    for _, build := range []string{"CRAB-CWS144-33", "CRAB-CWS144-JOB1-33", "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33"} {
+        var stdout, stderr bytes.Buffer
+        exitCode := historyCommand([]string{"-store", storeFile, build}, &stdout, &stderr)
+        if exitCode != 0 {
+            t.Fatalf("expected exit code 0 for %s but got %d: %s", build, exitCode, stderr.String())
+        }
+        assertContains(t, stdout.String(), "Build: CRAB-CWS144-33 (https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33)")
+        assertContains(t, stdout.String(), "Processed at: 2020-01-07T07:31:47Z")
+        assertContains(t, stdout.String(), "Outcome: commented")
+        assertContains(t, stdout.String(), "Log snippet:\nTimed out")
+    }
+
+    var stdout, stderr bytes.Buffer
+    exitCode := historyCommand([]string{"-store", storeFile, "-format", "json", "CRAB-CWS144-33"}, &stdout, &stderr)
+    if exitCode != 0 {
+        t.Fatalf("expected exit code 0 but got %d: %s", exitCode, stderr.String())
+    }
+    var output historyOutput
+    err = json.Unmarshal(stdout.Bytes(), &output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, output.Outcome, "commented")
+    assertEquals(t, output.Findings[0].Rule, "generic-error")
+
+    stdout.Reset()
+    exitCode = historyCommand([]string{"-store", storeFile, "CRAB-CWS145-7"}, &stdout, &stderr)
+    if exitCode != 1 {
+        t.Errorf("expected exit code 1 but got %d", exitCode)
+    }
+    assertContains(t, stdout.String(), "Bambot hasn't processed CRAB-CWS145-7.")
+}
+
+// `bambot serve` keeps its store open, so `bambot history` has to be able to read it at the same time
+func TestHistoryCommandWhileTheStoreIsOpen(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    err = store.RecordBuild(BuildRecord{Build: "CRAB-CWS144-33", Outcome: outcomeNoMatch})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var stdout, stderr bytes.Buffer
+    exitCode := historyCommand([]string{"-store", storeFile, "CRAB-CWS144-33"}, &stdout, &stderr)
+    if exitCode != 0 {
+        t.Fatalf("expected exit code 0 but got %d: %s", exitCode, stderr.String())
+    }
+    assertContains(t, stdout.String(), "Outcome: no-match")
+
+    // And the store can still be written to afterwards
+    err = store.RecordBuild(BuildRecord{Build: "CRAB-CWS144-34", Outcome: outcomeNoMatch})
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestHistoryCommandErrors(t *testing.T) {
+    var stdout, stderr bytes.Buffer
+    exitCode := historyCommand([]string{"-store", "does-not-exist.db", "CRAB-CWS144-33"}, &stdout, &stderr)
+    if exitCode != 1 {
+        t.Errorf("expected exit code 1 without a store but got %d", exitCode)
+    }
+
+    for _, args := range [][]string{
+        {},
+        {"CRAB-33"},
+        {"-format", "xml", "CRAB-CWS144-33"},
+    } {
+        exitCode := historyCommand(args, &stdout, &stderr)
+        if exitCode != 2 {
+            t.Errorf("expected exit code 2 for %v but got %d", args, exitCode)
+        }
+    }
+}
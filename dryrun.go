@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+)
+
+// Something Bambot would have done to a build, if it wasn't a dry run
+type DryRunAction struct {
+	// Ex: CRAB-CWS144-33
+	Build string `json:"build"`
+	// "comment" or "label"
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+// Wraps a Bamboo, passing reads through but only recording the comments and labels that would be added,
+// so rule changes can be previewed against real builds. What would be added is written to each build's output.
+type dryRunBamboo struct {
+	Bamboo
+	mutex   sync.Mutex
+	actions []DryRunAction
+}
+
+func newDryRunBamboo(bamboo Bamboo) *dryRunBamboo {
+	return &dryRunBamboo{Bamboo: bamboo}
+}
+
+func (bamboo *dryRunBamboo) AddComment(buildKey string, buildNumber string, content string) error {
+	bamboo.mutex.Lock()
+	defer bamboo.mutex.Unlock()
+	bamboo.actions = append(bamboo.actions, DryRunAction{Build: buildKey + "-" + buildNumber, Type: "comment", Content: content})
+	return nil
+}
+
+func (bamboo *dryRunBamboo) AddLabel(buildKey string, buildNumber string, label string) error {
+	bamboo.mutex.Lock()
+	defer bamboo.mutex.Unlock()
+	bamboo.actions = append(bamboo.actions, DryRunAction{Build: buildKey + "-" + buildNumber, Type: "label", Content: label})
+	return nil
+}
+
+// Write everything that would have been done as JSON
+func (bamboo *dryRunBamboo) writeReport(fileName string) error {
+	bamboo.mutex.Lock()
+	defer bamboo.mutex.Unlock()
+	report, err := json.MarshalIndent(bamboo.actions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, report, 0644)
+}
+
+// In a dry run, the comments and labels are written to the build's output instead of Bamboo
+func isDryRun(bamboo Bamboo) bool {
+	_, ok := bamboo.(*dryRunBamboo)
+	return ok
+}
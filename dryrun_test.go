@@ -0,0 +1,75 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDryRunDoesntWriteToBamboo(t *testing.T) {
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()},
+    }
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    dryRun := newDryRunBamboo(bamboo)
+    _, err := handleAllBuilds(dryRun, testRules, nil, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(bamboo.comments) > 0 || len(bamboo.labels) > 0 {
+        t.Errorf("expected no comments or labels, but found %v and %v", bamboo.comments, bamboo.labels)
+    }
+
+    dir, err := ioutil.TempDir("", "bambot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    reportFile := filepath.Join(dir, "report.json")
+    err = dryRun.writeReport(reportFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var actions []DryRunAction
+    err = json.Unmarshal([]byte(readFileToString(reportFile)), &actions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(actions) != 2 {
+        t.Fatalf("expected 2 actions, but found %d", len(actions))
+    }
+    assertEquals(t, actions[0].Build, "CRAB-CWS144-33")
+    assertEquals(t, actions[0].Type, "comment")
+    assertContains(t, actions[0].Content, "Bambot detected an error!")
+    assertEquals(t, actions[1].Type, "label")
+    assertEquals(t, actions[1].Content, "bambot-scanned")
+}
+
+// Builds are handled concurrently, so what a dry run would add goes to the build's own output
+func TestDryRunWritesCommentToOutput(t *testing.T) {
+    bamboo := newFakeBamboo()
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    recentResult := RecentResult{Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()}
+
+    var output strings.Builder
+    err := handleBuild(recentResult, newDryRunBamboo(bamboo), testRules, nil, nil, newScanStats(), &output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertContains(t, output.String(), "Dry run, not adding comment & 'bambot-scanned' label:\nBambot detected an error!")
+    assertNotContains(t, output.String(), "Sent a comment")
+
+    output.Reset()
+    err = handleBuild(recentResult, bamboo, testRules, nil, nil, newScanStats(), &output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertContains(t, output.String(), "Adding comment & 'bambot-scanned' label ... Sent a comment with length ")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+)
+
+// The services Bambot sends requests to
+const (
+	bambooService = "Bamboo"
+	jiraService   = "JIRA"
+	slackService  = "Slack"
+)
+
+// A request to Bamboo, JIRA or Slack failed, or the response wasn't what we expected
+type RequestError struct {
+	// Ex: Bamboo
+	Service string
+	// What we were trying to do, Ex: "get labels"
+	Operation string
+	Url       string
+	// The HTTP status code of the response, or 0 if there was no response
+	StatusCode int
+	// The underlying error, if any
+	Err error
+	// Details about an unexpected response
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return requestErrorText(e.Operation, e.Url, e.StatusCode, e.Message, e.Err)
+}
+
+func requestErrorText(operation string, url string, statusCode int, message string, err error) string {
+	text := "failed to " + operation + " (" + url + ")"
+	if statusCode != 0 {
+		text += ": status code " + strconv.Itoa(statusCode)
+	}
+	if message != "" {
+		text += ": " + message
+	}
+	if err != nil {
+		text += ": " + err.Error()
+	}
+	// The responses and Go's errors might include a password or the Authorization header
+	return redact(text)
+}
+
+// A link to a build didn't end with a build ID in the format we expect, Ex: CRAB-CWS144-JOB1-33 or CRAB-CWS144-33
+type BuildIdError struct {
+	Link    string
+	BuildId string
+}
+
+func (e *BuildIdError) Error() string {
+	return "unexpected format of build ID: " + e.BuildId + " (" + e.Link + ")"
+}
+
+// A build that couldn't be processed, and why
+type BuildFailure struct {
+	Link string
+	Err  error
+}
+
+// Bamboo redirects to the login page when the session has expired, and the REST API responds with 401
+func isSessionExpired(err error) bool {
+	requestErr, ok := err.(*RequestError)
+	return ok && requestErr.Service == bambooService && (requestErr.StatusCode == 302 || requestErr.StatusCode == 401)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "io"
+    "io/ioutil"
+    "strings"
+    "sync"
+    "time"
+)
+
+// An in-memory Bamboo, which records the comments and labels Bambot adds.
+// Set it up before handling any builds; the maps are safe to read once the builds have been handled.
+type fakeBamboo struct {
+    // Builds are handled concurrently
+    mutex sync.Mutex
+
+    recentResults []RecentResult
+    // Keyed by build key and number, Ex: CRAB-CWS144-33
+    results  map[string]BambooResult
+    labels   map[string][]string
+    comments map[string][]string
+    // Keyed by job result key, Ex: CRAB-CWS144-JOB1-33
+    logs map[string]string
+    // Keyed by the name of the method that should fail
+    errors map[string]error
+}
+
+func newFakeBamboo() *fakeBamboo {
+    return &fakeBamboo{
+        results:  make(map[string]BambooResult),
+        labels:   make(map[string][]string),
+        comments: make(map[string][]string),
+        logs:     make(map[string]string),
+        errors:   make(map[string]error),
+    }
+}
+
+// The recent results must be listed most recent first
+func (bamboo *fakeBamboo) ListRecentResults(maxResults int, before time.Time) ([]RecentResult, error) {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    if err := bamboo.errors["ListRecentResults"]; err != nil {
+        return nil, err
+    }
+    var results []RecentResult
+    for _, result := range bamboo.recentResults {
+        if len(results) == maxResults {
+            break
+        }
+        if before.IsZero() || result.Published.Before(before) {
+            results = append(results, result)
+        }
+    }
+    return results, nil
+}
+
+func (bamboo *fakeBamboo) GetResult(buildKey string, buildNumber string) (BambooResult, error) {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    if err := bamboo.errors["GetResult"]; err != nil {
+        return BambooResult{}, err
+    }
+    return bamboo.results[buildKey+"-"+buildNumber], nil
+}
+
+func (bamboo *fakeBamboo) GetLabels(buildKey string, buildNumber string) ([]string, error) {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    if err := bamboo.errors["GetLabels"]; err != nil {
+        return nil, err
+    }
+    return bamboo.labels[buildKey+"-"+buildNumber], nil
+}
+
+func (bamboo *fakeBamboo) AddLabel(buildKey string, buildNumber string, label string) error {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    if err := bamboo.errors["AddLabel"]; err != nil {
+        return err
+    }
+    bamboo.labels[buildKey+"-"+buildNumber] = append(bamboo.labels[buildKey+"-"+buildNumber], label)
+    return nil
+}
+
+func (bamboo *fakeBamboo) AddComment(buildKey string, buildNumber string, content string) error {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    if err := bamboo.errors["AddComment"]; err != nil {
+        return err
+    }
+    bamboo.comments[buildKey+"-"+buildNumber] = append(bamboo.comments[buildKey+"-"+buildNumber], content)
+    return nil
+}
+
+func (bamboo *fakeBamboo) DownloadJobLog(job BambooJobResult) (io.ReadCloser, error) {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    if err := bamboo.errors["DownloadJobLog"]; err != nil {
+        return nil, err
+    }
+    log, ok := bamboo.logs[job.Key]
+    if !ok {
+        return nil, &RequestError{Service: bambooService, Operation: "download logs", Url: job.Key, StatusCode: 404}
+    }
+    return ioutil.NopCloser(strings.NewReader(log)), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// An issue in the fake JIRA server
+type fakeJiraIssue struct {
+    key         string
+    project     string
+    summary     string
+    description string
+    issueType   string
+    labels      []string
+    resolved    bool
+}
+
+// An in-process JIRA server, which searches its issues the way Bambot's JQL asks (by a word in the description,
+// and whether they're resolved) and records the issues Bambot files
+type fakeJiraServer struct {
+    *httptest.Server
+
+    token string
+
+    mutex sync.Mutex
+    // In the order they were updated, oldest first
+    issues []fakeJiraIssue
+    // The JQL of every search
+    searches []string
+    // The issues Bambot filed
+    created []fakeJiraIssue
+    // If not 0, every request fails with this status code
+    failWith int
+}
+
+func newFakeJiraServer() *fakeJiraServer {
+    server := &fakeJiraServer{token: "fake-jira-token-1234"}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/rest/api/2/search", server.requireToken(server.handleSearch))
+    mux.HandleFunc("/rest/api/2/issue", server.requireToken(server.handleCreate))
+    server.Server = httptest.NewServer(mux)
+    return server
+}
+
+func (server *fakeJiraServer) newTracker(project string, createAfter int) *jiraTracker {
+    client := newJiraClient(server.URL, &http.Client{}, "Bearer "+server.token)
+    return newJiraTracker(client, project, defaultJiraIssueType, createAfter, false)
+}
+
+func (server *fakeJiraServer) addIssue(issue fakeJiraIssue) {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    server.issues = append(server.issues, issue)
+}
+
+func (server *fakeJiraServer) recordedSearches() []string {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    return append([]string(nil), server.searches...)
+}
+
+func (server *fakeJiraServer) createdIssues() []fakeJiraIssue {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    return append([]fakeJiraIssue(nil), server.created...)
+}
+
+func (server *fakeJiraServer) setFailWith(statusCode int) {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    server.failWith = statusCode
+}
+
+func (server *fakeJiraServer) requireToken(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "Bearer "+server.token {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        server.mutex.Lock()
+        failWith := server.failWith
+        server.mutex.Unlock()
+        if failWith != 0 {
+            http.Error(w, "JIRA is having a bad day", failWith)
+            return
+        }
+        handler(w, r)
+    }
+}
+
+// Ex: description ~ "3f786850e387550f" AND resolution = Unresolved ORDER BY updated DESC
+var fakeJqlRegexp = regexp.MustCompile(`^description ~ "([^"]+)"( AND resolution = Unresolved)? ORDER BY updated DESC$`)
+
+func (server *fakeJiraServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+    jql := r.URL.Query().Get("jql")
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    server.searches = append(server.searches, jql)
+
+    match := fakeJqlRegexp.FindStringSubmatch(jql)
+    if match == nil {
+        http.Error(w, "The fake server doesn't understand this JQL", http.StatusBadRequest)
+        return
+    }
+    maxResults, err := strconv.Atoi(r.URL.Query().Get("maxResults"))
+    if err != nil {
+        http.Error(w, "Bad maxResults", http.StatusBadRequest)
+        return
+    }
+
+    type result struct {
+        Key    string `json:"key"`
+        Fields struct {
+            Summary string `json:"summary"`
+            Project struct {
+                Key string `json:"key"`
+            } `json:"project"`
+        } `json:"fields"`
+    }
+    results := []result{}
+    for idx := len(server.issues) - 1; idx >= 0 && len(results) < maxResults; idx-- {
+        issue := server.issues[idx]
+        if !strings.Contains(issue.description, match[1]) || (match[2] != "" && issue.resolved) {
+            continue
+        }
+        var found result
+        found.Key = issue.key
+        found.Fields.Summary = issue.summary
+        found.Fields.Project.Key = issue.project
+        results = append(results, found)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]interface{}{"total": len(results), "issues": results})
+}
+
+func (server *fakeJiraServer) handleCreate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var request struct {
+        Fields struct {
+            Project struct {
+                Key string `json:"key"`
+            } `json:"project"`
+            IssueType struct {
+                Name string `json:"name"`
+            } `json:"issuetype"`
+            Summary     string   `json:"summary"`
+            Description string   `json:"description"`
+            Labels      []string `json:"labels"`
+        } `json:"fields"`
+    }
+    err := json.NewDecoder(r.Body).Decode(&request)
+    if err != nil || request.Fields.Project.Key == "" || request.Fields.Summary == "" {
+        http.Error(w, "Invalid issue", http.StatusBadRequest)
+        return
+    }
+
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    issue := fakeJiraIssue{
+        key:         fmt.Sprintf("%s-%d", request.Fields.Project.Key, 100+len(server.issues)),
+        project:     request.Fields.Project.Key,
+        summary:     request.Fields.Summary,
+        description: request.Fields.Description,
+        issueType:   request.Fields.IssueType.Name,
+        labels:      request.Fields.Labels,
+    }
+    server.issues = append(server.issues, issue)
+    server.created = append(server.created, issue)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    _ = json.NewEncoder(w).Encode(map[string]string{"id": strconv.Itoa(len(server.issues)), "key": issue.key})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+    "encoding/xml"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// One entry in the fake server's activity stream
+type fakeFeedEntry struct {
+    // Ex: CRAB-CWS144-JOB1-33
+    buildId   string
+    published time.Time
+    // Ex: build.failed or build.successful
+    category string
+    content  string
+}
+
+// An in-process Bamboo server, serving the pages and REST endpoints Bambot uses from fixtures,
+// and recording the comments and labels Bambot posts
+type fakeBambooServer struct {
+    *httptest.Server
+
+    username   string
+    password   string
+    jSessionId string
+    // A personal access token, which works for every request
+    token string
+
+    entries []fakeFeedEntry
+    // The XML of each build result, keyed by build key and number, Ex: CRAB-CWS144-33
+    results map[string]string
+    // Keyed by job result key, Ex: CRAB-CWS144-JOB1-33
+    logs map[string]string
+
+    mutex sync.Mutex
+    // Keyed by build key and number
+    labels   map[string][]string
+    comments map[string][]string
+    // Every request, Ex: "GET /plugins/servlet/streams"
+    requests []string
+}
+
+func newFakeBambooServer() *fakeBambooServer {
+    server := &fakeBambooServer{
+        username:   "bambot",
+        password:   "hunter2",
+        jSessionId: "0123456789ABCDEF0123456789ABCDEF",
+        token:      "NjQ1MzI4OTk3ODQ5OmZha2UtdG9rZW4=",
+        results:    make(map[string]string),
+        logs:       make(map[string]string),
+        labels:     make(map[string][]string),
+        comments:   make(map[string][]string),
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/userlogin.action", server.handleLogin)
+    mux.HandleFunc("/plugins/servlet/streams", server.requireSession(server.handleStream))
+    mux.HandleFunc("/rest/api/latest/result/", server.requireBasicAuth(server.handleResult))
+    mux.HandleFunc("/download/", server.requireSession(server.handleDownload))
+    server.Server = httptest.NewServer(server.recordRequests(mux))
+    return server
+}
+
+// A client for the fake server, which doesn't follow redirects (just like the real one)
+func (server *fakeBambooServer) newClient() *BambooClient {
+    httpClient := &http.Client{
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    return newBambooClient(server.URL, httpClient)
+}
+
+func (server *fakeBambooServer) addEntry(buildId string, published time.Time, category string, content string) {
+    server.entries = append(server.entries, fakeFeedEntry{buildId: buildId, published: published, category: category, content: content})
+}
+
+// Forget the current session, just like Bamboo does after a while, so the client has to log in again
+func (server *fakeBambooServer) expireSession(newJSessionId string) {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    server.jSessionId = newJSessionId
+}
+
+func (server *fakeBambooServer) currentJSessionId() string {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    return server.jSessionId
+}
+
+func (server *fakeBambooServer) recordedComments(buildKeyAndNumber string) []string {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    return server.comments[buildKeyAndNumber]
+}
+
+func (server *fakeBambooServer) recordedLabels(buildKeyAndNumber string) []string {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    return server.labels[buildKeyAndNumber]
+}
+
+func (server *fakeBambooServer) recordedRequests() []string {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    return append([]string(nil), server.requests...)
+}
+
+func (server *fakeBambooServer) recordRequests(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        server.mutex.Lock()
+        server.requests = append(server.requests, r.Method+" "+r.URL.Path)
+        server.mutex.Unlock()
+        handler.ServeHTTP(w, r)
+    })
+}
+
+func (server *fakeBambooServer) hasToken(r *http.Request) bool {
+    return r.Header.Get("Authorization") == "Bearer "+server.token
+}
+
+// Pages for browsers need the session cookie from logging in, or the token
+func (server *fakeBambooServer) requireSession(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if server.hasToken(r) {
+            handler(w, r)
+            return
+        }
+        if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        cookie, err := r.Cookie("JSESSIONID")
+        if err != nil || cookie.Value != server.currentJSessionId() {
+            http.Redirect(w, r, server.URL+"/userlogin!doDefault.action", http.StatusFound)
+            return
+        }
+        handler(w, r)
+    }
+}
+
+// The REST API needs HTTP Basic authorization, or the token
+func (server *fakeBambooServer) requireBasicAuth(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if server.hasToken(r) {
+            handler(w, r)
+            return
+        }
+        username, password, ok := r.BasicAuth()
+        if !ok || username != server.username || password != server.password {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        handler(w, r)
+    }
+}
+
+func (server *fakeBambooServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if r.FormValue("os_username") != server.username || r.FormValue("os_password") != server.password {
+        // Bamboo shows the login page again
+        _, _ = fmt.Fprint(w, "<html>Login</html>")
+        return
+    }
+    w.Header().Set("Set-Cookie", "JSESSIONID="+server.currentJSessionId()+"; Path=/; HttpOnly")
+    http.Redirect(w, r, server.URL+r.FormValue("os_destination"), http.StatusFound)
+}
+
+// Like Bamboo, serves the newest maxResults entries published before maxDate (in milliseconds), if given
+func (server *fakeBambooServer) handleStream(w http.ResponseWriter, r *http.Request) {
+    maxResults, err := strconv.Atoi(r.FormValue("maxResults"))
+    if err != nil {
+        http.Error(w, "Invalid maxResults", http.StatusBadRequest)
+        return
+    }
+    var maxDate time.Time
+    if r.FormValue("maxDate") != "" {
+        millis, err := strconv.ParseInt(r.FormValue("maxDate"), 10, 64)
+        if err != nil {
+            http.Error(w, "Invalid maxDate", http.StatusBadRequest)
+            return
+        }
+        maxDate = time.Unix(0, millis*int64(time.Millisecond))
+    }
+
+    entries := server.newestEntries()
+
+    var feed strings.Builder
+    feed.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+    feed.WriteString(`<feed xmlns="http://www.w3.org/2005/Atom">` + "\n")
+    feed.WriteString("<title>Activity Stream</title>\n")
+    count := 0
+    for _, entry := range entries {
+        if count == maxResults {
+            break
+        }
+        if !maxDate.IsZero() && !entry.published.Before(maxDate) {
+            continue
+        }
+        count++
+        feed.WriteString("<entry>\n")
+        feed.WriteString("<title>" + escapeXmlString(entry.buildId) + "</title>\n")
+        feed.WriteString(`<content type="html">` + escapeXmlString(entry.content) + "</content>\n")
+        feed.WriteString(`<link rel="alternate" href="` + server.URL + "/browse/" + entry.buildId + `"/>` + "\n")
+        feed.WriteString("<published>" + entry.published.UTC().Format(time.RFC3339) + "</published>\n")
+        feed.WriteString(`<category term="` + entry.category + `"/>` + "\n")
+        feed.WriteString("</entry>\n")
+    }
+    feed.WriteString("</feed>\n")
+    w.Header().Set("Content-Type", "application/atom+xml")
+    _, _ = fmt.Fprint(w, feed.String())
+}
+
+// The entries in the activity stream, newest first
+func (server *fakeBambooServer) newestEntries() []fakeFeedEntry {
+    entries := append([]fakeFeedEntry(nil), server.entries...)
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].published.After(entries[j].published)
+    })
+    return entries
+}
+
+func (server *fakeBambooServer) writeLabels(w http.ResponseWriter, buildKeyAndNumber string) {
+    var labels strings.Builder
+    labels.WriteString(`<labels size="` + strconv.Itoa(len(server.labels[buildKeyAndNumber])) + `">`)
+    for _, label := range server.labels[buildKeyAndNumber] {
+        labels.WriteString(`<label name="` + escapeXmlString(label) + `"/>`)
+    }
+    labels.WriteString(`</labels>`)
+    w.Header().Set("Content-Type", "application/xml")
+    _, _ = fmt.Fprint(w, labels.String())
+}
+
+func (server *fakeBambooServer) handleLabels(w http.ResponseWriter, r *http.Request, buildKeyAndNumber string) {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    if r.Method == "POST" {
+        var label struct {
+            Name string `xml:"name"`
+        }
+        body, err := ioutil.ReadAll(r.Body)
+        if err == nil {
+            err = xml.Unmarshal(body, &label)
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        server.labels[buildKeyAndNumber] = append(server.labels[buildKeyAndNumber], label.Name)
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    server.writeLabels(w, buildKeyAndNumber)
+}
+
+// Serves /rest/api/latest/result/CRAB-CWS144/33, /rest/api/latest/result/CRAB-CWS144-33/comment
+// and /rest/api/latest/result/CRAB-CWS144-33/label
+func (server *fakeBambooServer) handleResult(w http.ResponseWriter, r *http.Request) {
+    path := strings.TrimPrefix(r.URL.Path, "/rest/api/latest/result/")
+    if strings.HasSuffix(path, "/comment") && r.Method == "POST" {
+        server.handleAddComment(w, r, strings.TrimSuffix(path, "/comment"))
+        return
+    }
+    if strings.HasSuffix(path, "/label") {
+        server.handleLabels(w, r, strings.TrimSuffix(path, "/label"))
+        return
+    }
+
+    buildKeyAndNumber := strings.Replace(path, "/", "-", 1)
+    result, ok := server.results[buildKeyAndNumber]
+    if !ok {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", "application/xml")
+    _, _ = fmt.Fprint(w, result)
+}
+
+func (server *fakeBambooServer) handleAddComment(w http.ResponseWriter, r *http.Request, buildKeyAndNumber string) {
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    var comment struct {
+        Content string `xml:"content"`
+    }
+    err = xml.Unmarshal(body, &comment)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    server.comments[buildKeyAndNumber] = append(server.comments[buildKeyAndNumber], comment.Content)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves /download/CRAB-CWS144-JOB1/build_logs/CRAB-CWS144-JOB1-33.log
+func (server *fakeBambooServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+    if len(parts) != 3 || parts[1] != "build_logs" {
+        http.NotFound(w, r)
+        return
+    }
+    jobResultKey := strings.TrimSuffix(parts[2], ".log")
+    log, ok := server.logs[jobResultKey]
+    if !ok || !strings.HasPrefix(jobResultKey, parts[0]+"-") {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain")
+    _, _ = fmt.Fprint(w, log)
+}
+
+// Ex: CRAB-CWS144-33 for the job result CRAB-CWS144-JOB1-33
+func planResultKey(jobResultKey string) string {
+    parts := strings.Split(jobResultKey, "-")
+    return strings.Join(parts[0:2], "-") + "-" + parts[len(parts)-1]
+}
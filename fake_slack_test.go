@@ -0,0 +1,62 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+)
+
+// An in-process Slack incoming webhook, which records the messages Bambot posts
+type fakeSlackWebhook struct {
+    *httptest.Server
+
+    mutex    sync.Mutex
+    messages []slackMessage
+    // If not 0, every message is rejected with this status code
+    failWith int
+}
+
+func newFakeSlackWebhook() *fakeSlackWebhook {
+    webhook := &fakeSlackWebhook{}
+    webhook.Server = httptest.NewServer(http.HandlerFunc(webhook.handleMessage))
+    return webhook
+}
+
+// Like Slack's, the URL is the only thing that says which channel a message goes to
+func (webhook *fakeSlackWebhook) webhookUrl() string {
+    return webhook.URL + "/services/T0000/B0000/XXXXXXXXXXXXXXXXXXXXXXXX"
+}
+
+// A notifier for the default webhook only
+func (webhook *fakeSlackWebhook) newNotifier() *slackNotifier {
+    return newSlackNotifier(map[string]string{"": webhook.webhookUrl()}, &http.Client{}, SlackRouting{}, false)
+}
+
+func (webhook *fakeSlackWebhook) recordedMessages() []slackMessage {
+    webhook.mutex.Lock()
+    defer webhook.mutex.Unlock()
+    return append([]slackMessage(nil), webhook.messages...)
+}
+
+// Like Slack, answers "ok" or an error code in plain text
+func (webhook *fakeSlackWebhook) handleMessage(w http.ResponseWriter, r *http.Request) {
+    webhook.mutex.Lock()
+    defer webhook.mutex.Unlock()
+    if webhook.failWith != 0 {
+        http.Error(w, "no_service", webhook.failWith)
+        return
+    }
+    if r.Method != "POST" || r.URL.Path != "/services/T0000/B0000/XXXXXXXXXXXXXXXXXXXXXXXX" {
+        http.Error(w, "no_service", http.StatusNotFound)
+        return
+    }
+    var message slackMessage
+    err := json.NewDecoder(r.Body).Decode(&message)
+    if err != nil || message.Text == "" {
+        http.Error(w, "invalid_payload", http.StatusBadRequest)
+        return
+    }
+    webhook.messages = append(webhook.messages, message)
+    _, _ = w.Write([]byte("ok"))
+}
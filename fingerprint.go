@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// How many hex digits of the hash are kept in a fingerprint
+const fingerprintLength = 16
+
+// How findings are fingerprinted, from the rules file
+type FingerprintOptions struct {
+	// If true, line numbers (Ex: Foo.cs(12,5) or foo.py:123) don't change the fingerprint, so a failure is still
+	// recognized after the code around it moves
+	IgnoreLineNumbers bool `json:"ignoreLineNumbers,omitempty"`
+}
+
+// A part of a snippet that differs from build to build, even when the failure is the same
+type normalization struct {
+	regexp      *regexp.Regexp
+	replacement string
+}
+
+// Applied in order, so that Ex: the time in a timestamp isn't mistaken for a line number
+var normalizations = []normalization{
+	// Ex: 3F2504E0-4F89-11D3-9A0C-0305E82C3301
+	{regexp.MustCompile(`\b[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}\b`), "<guid>"},
+	// Ex: 2020-01-07T07:31:47.123Z, 07-Jan-2020 07:31:47, 1/7/2020 and 07:31:47
+	{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}(?::\d{2}(?:[.,]\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?)?\b`), "<time>"},
+	{regexp.MustCompile(`\b\d{1,2}-[A-Z][a-z]{2}-\d{4}\b`), "<time>"},
+	{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{2,4}\b`), "<time>"},
+	{regexp.MustCompile(`\b\d{1,2}:\d{2}:\d{2}(?:[.,]\d+)?(?:\s?[AaPp][Mm])?\b`), "<time>"},
+	// Ex: C:\build\CRAB-CWS144-JOB1\net-link or /home/bamboo/build-dir/CRAB-CWS144-JOB1/src
+	{regexp.MustCompile(`([\\/]build(?:-dir)?[\\/])[A-Z][A-Z0-9]*-[A-Z0-9]+(?:-[A-Z0-9]+)*`), "${1}<plan>"},
+	// Ex: CRAB-CWS144-33 or CRAB-CWS144-JOB1-33
+	{regexp.MustCompile(`\b[A-Z][A-Z0-9]*-[A-Z0-9]+(?:-[A-Z0-9]+)?-\d+\b`), "<build>"},
+	// Ex: build #33, or buildNumber=33
+	{regexp.MustCompile(`(?i)\b(build(?:[ _.-]?number)?\s*[#:=]?\s*)\d+\b`), "${1}<number>"},
+}
+
+// Only applied with IgnoreLineNumbers
+var lineNumberNormalizations = []normalization{
+	// Ex: Foo.cs(12,5)
+	{regexp.MustCompile(`(\.[A-Za-z]\w*)\(\d+(?:,\d+)*\)`), "${1}(<line>)"},
+	// Ex: Foo.java:[12,5]
+	{regexp.MustCompile(`(\.[A-Za-z]\w*):\[\d+(?:,\d+)*\]`), "${1}:[<line>]"},
+	// Ex: foo.py:123 or foo.js:12:5
+	{regexp.MustCompile(`(\.[A-Za-z]\w*)(?::\d+)+\b`), "${1}:<line>"},
+	// Ex: File "foo.py", line 123
+	{regexp.MustCompile(`\b(line\s+)\d+\b`), "${1}<line>"},
+}
+
+// Identifies the same failure across builds and branches: a hash of the rule and the snippet, ignoring indentation
+// and everything that changes from build to build, like timestamps, GUIDs, build numbers, and the build directory
+func fingerprint(finding Finding, options FingerprintOptions) string {
+	lines := strings.Split(normalizeSnippet(finding.LogSnippet, options), "\n")
+	for idx, line := range lines {
+		lines[idx] = strings.TrimSpace(line)
+	}
+	hash := sha256.Sum256([]byte(finding.RuleName + "\n" + strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:])[:fingerprintLength]
+}
+
+func normalizeSnippet(snippet string, options FingerprintOptions) string {
+	for _, normalization := range normalizations {
+		snippet = normalization.regexp.ReplaceAllString(snippet, normalization.replacement)
+	}
+	if options.IgnoreLineNumbers {
+		for _, normalization := range lineNumberNormalizations {
+			snippet = normalization.regexp.ReplaceAllString(snippet, normalization.replacement)
+		}
+	}
+	return snippet
+}
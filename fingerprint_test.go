@@ -0,0 +1,49 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+const fingerprintedSnippet = `2020-01-07T07:31:47.123Z Build CRAB-CWS144-JOB1-33 started (build #33)
+C:\build\CRAB-CWS144-JOB1\net-link\Seeq.Link.sln : error at 07:31:47 PM
+Session 3F2504E0-4F89-11D3-9A0C-0305E82C3301 failed on 07-Jan-2020
+Seeq.Link.SDK\Connection.cs(12,5): error CS0103: The name 'foo' does not exist`
+
+func TestNormalizeSnippet(t *testing.T) {
+    assertEquals(t, normalizeSnippet(fingerprintedSnippet, FingerprintOptions{}),
+        `<time> Build <build> started (build #<number>)
+C:\build\<plan>\net-link\Seeq.Link.sln : error at <time>
+Session <guid> failed on <time>
+Seeq.Link.SDK\Connection.cs(12,5): error CS0103: The name 'foo' does not exist`)
+
+    assertEquals(t, normalizeSnippet(`Connection.cs(12,5) Foo.java:[12,5] foo.py:123 foo.js:12:5 File "foo.py", line 12`, FingerprintOptions{IgnoreLineNumbers: true}),
+        `Connection.cs(<line>) Foo.java:[<line>] foo.py:<line> foo.js:<line> File "foo.py", line <line>`)
+}
+
+// The same failure in another build, on another branch, on another day
+func TestFingerprintIgnoresWhatChangesBetweenBuilds(t *testing.T) {
+    finding := Finding{RuleName: "csharp-compiler-error", LogSnippet: fingerprintedSnippet}
+    sameFailure := Finding{RuleName: "csharp-compiler-error", LogSnippet: `2020-03-01T12:00:00.000Z Build CRAB-CWS150-JOB1-7 started (build #7)
+    C:\build\CRAB-CWS150-JOB1\net-link\Seeq.Link.sln : error at 12:00:01 PM
+    Session 9A0C0305-4F89-11D3-3F25-04E0E82C3301 failed on 01-Mar-2020
+    Seeq.Link.SDK\Connection.cs(12,5): error CS0103: The name 'foo' does not exist`}
+    assertEquals(t, fingerprint(sameFailure, FingerprintOptions{}), fingerprint(finding, FingerprintOptions{}))
+
+    // Line numbers only count if they aren't ignored
+    moved := Finding{RuleName: finding.RuleName, LogSnippet: strings.Replace(fingerprintedSnippet, "(12,5)", "(14,5)", 1)}
+    if fingerprint(moved, FingerprintOptions{}) == fingerprint(finding, FingerprintOptions{}) {
+        t.Errorf("expected a different line number to change the fingerprint")
+    }
+    assertEquals(t, fingerprint(moved, FingerprintOptions{IgnoreLineNumbers: true}), fingerprint(finding, FingerprintOptions{IgnoreLineNumbers: true}))
+
+    // A different error, or a different rule, is a different failure
+    different := Finding{RuleName: finding.RuleName, LogSnippet: strings.Replace(fingerprintedSnippet, "CS0103", "CS0246", 1)}
+    if fingerprint(different, FingerprintOptions{}) == fingerprint(finding, FingerprintOptions{}) {
+        t.Errorf("expected a different error to change the fingerprint")
+    }
+    different = Finding{RuleName: "csharp-build-failure", LogSnippet: fingerprintedSnippet}
+    if fingerprint(different, FingerprintOptions{}) == fingerprint(finding, FingerprintOptions{}) {
+        t.Errorf("expected a different rule to change the fingerprint")
+    }
+}
@@ -0,0 +1,15 @@
+module github.com/srosenthal/bambot
+
+go 1.25.0
+
+require (
+	github.com/mmcdole/gofeed v1.4.2
+	go.etcd.io/bbolt v1.3.10
+)
+
+require (
+	github.com/mmcdole/goxpp/v2 v2.0.0 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
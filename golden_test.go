@@ -0,0 +1,142 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// Regenerate the expected findings of every fixture log: go test -run TestFixtureLogs -update
+var update = flag.Bool("update", false, "rewrite the test_files/*.expected.json files from the current rules")
+
+// The sidecar file next to each fixture log, Ex: test_files/grunt-1.expected.json for test_files/grunt-1.log
+type expectedFindings struct {
+    Findings []expectedFinding `json:"findings"`
+}
+
+type expectedFinding struct {
+    Rule        string `json:"rule"`
+    Comment     string `json:"comment"`
+    JiraIssueId string `json:"jiraIssueId,omitempty"`
+    // The line numbers (starting at 1) of the first and last lines of the snippet
+    FirstLine int `json:"firstLine"`
+    LastLine  int `json:"lastLine"`
+    // Written by hand, and kept when the file is regenerated
+    MustContain    []string `json:"mustContain,omitempty"`
+    MustNotContain []string `json:"mustNotContain,omitempty"`
+}
+
+// Every log in test_files must produce exactly the findings described by its sidecar file
+func TestFixtureLogs(t *testing.T) {
+    logFiles, err := filepath.Glob("test_files/*.log")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(logFiles) == 0 {
+        t.Fatal("no fixture logs found in test_files")
+    }
+    for _, logFile := range logFiles {
+        logFile := logFile
+        t.Run(filepath.Base(logFile), func(t *testing.T) {
+            checkFixtureLog(t, logFile)
+        })
+    }
+}
+
+func checkFixtureLog(t *testing.T, logFile string) {
+    file, err := os.Open(logFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    scanResult, err := scanReader(file, testRules)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expectedFile := strings.TrimSuffix(logFile, ".log") + ".expected.json"
+    expected, err := readExpectedFindings(expectedFile)
+    if *update {
+        if err != nil && !os.IsNotExist(err) {
+            t.Fatal(err)
+        }
+        err = writeExpectedFindings(expectedFile, regenerateExpectedFindings(scanResult, expected))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+    if err != nil {
+        t.Fatalf("%v (run 'go test -run TestFixtureLogs -update' to create it)", err)
+    }
+
+    if len(scanResult.Findings) != len(expected.Findings) {
+        t.Fatalf("expected %d findings but found %d: %v", len(expected.Findings), len(scanResult.Findings), scanResult.Findings)
+    }
+    for idx, finding := range scanResult.Findings {
+        want := expected.Findings[idx]
+        assertEquals(t, finding.RuleName, want.Rule)
+        assertEquals(t, finding.Comment, want.Comment)
+        assertEquals(t, finding.JiraIssueId, want.JiraIssueId)
+        if finding.firstLine+1 != want.FirstLine || finding.lastLine+1 != want.LastLine {
+            t.Errorf("expected %s to match lines %d-%d but it matched lines %d-%d",
+                want.Rule, want.FirstLine, want.LastLine, finding.firstLine+1, finding.lastLine+1)
+        }
+        for _, line := range want.MustContain {
+            assertContains(t, finding.LogSnippet, line)
+        }
+        for _, line := range want.MustNotContain {
+            assertNotContains(t, finding.LogSnippet, line)
+        }
+    }
+}
+
+// The findings as they are now, keeping the hand-written lines of findings from the same rule
+func regenerateExpectedFindings(scanResult ScanResult, previous expectedFindings) expectedFindings {
+    previousByRule := make(map[string]expectedFinding)
+    for _, finding := range previous.Findings {
+        previousByRule[finding.Rule] = finding
+    }
+
+    var regenerated expectedFindings
+    for _, finding := range scanResult.Findings {
+        regenerated.Findings = append(regenerated.Findings, expectedFinding{
+            Rule:           finding.RuleName,
+            Comment:        finding.Comment,
+            JiraIssueId:    finding.JiraIssueId,
+            FirstLine:      finding.firstLine + 1,
+            LastLine:       finding.lastLine + 1,
+            MustContain:    previousByRule[finding.RuleName].MustContain,
+            MustNotContain: previousByRule[finding.RuleName].MustNotContain,
+        })
+    }
+    return regenerated
+}
+
+func readExpectedFindings(fileName string) (expectedFindings, error) {
+    var expected expectedFindings
+    content, err := ioutil.ReadFile(fileName)
+    if err != nil {
+        return expected, err
+    }
+    err = json.Unmarshal(content, &expected)
+    return expected, err
+}
+
+func writeExpectedFindings(fileName string, expected expectedFindings) error {
+    var content bytes.Buffer
+    encoder := json.NewEncoder(&content)
+    // Log lines are full of < and >, which should stay readable
+    encoder.SetEscapeHTML(false)
+    encoder.SetIndent("", "  ")
+    err := encoder.Encode(expected)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(fileName, content.Bytes(), 0644)
+}
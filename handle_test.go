@@ -0,0 +1,297 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestHandleAllBuilds(t *testing.T) {
+    bamboo := newFakeBamboo()
+    now := time.Now()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: now},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: now.Add(-time.Minute)},
+        {Link: "https://bamboo.example.com/browse/not-a-build", Published: now.Add(-2 * time.Minute)},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS146-JOB1-12", Published: now.Add(-3 * time.Minute), Content: "2 tests failed"},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWO301-JOB1-5", Published: now.Add(-4 * time.Minute), Successful: true},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS147-JOB1-2", Published: now.Add(-30 * 24 * time.Hour)},
+    }
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    bamboo.labels["CRAB-CWS145-7"] = []string{"bambot-scanned"}
+    bamboo.results["CRAB-CWO301-5"] = BambooResult{PlanName: "release-R22.0.43", BuildState: "Successful", VcsRevisionKey: "abc123"}
+
+    stats, err := handleAllBuilds(bamboo, testRules, nil, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    comments := bamboo.comments["CRAB-CWS144-33"]
+    if len(comments) != 1 {
+        t.Fatalf("expected one comment on CRAB-CWS144-33, but found %d", len(comments))
+    }
+    assertContains(t, comments[0], "Bambot detected an error!")
+    assertContains(t, comments[0], "Timed out waiting for Seeq Server to become responsive.")
+    assertEquals(t, bamboo.labels["CRAB-CWS144-33"][0], "bambot-scanned")
+
+    // Builds that were already scanned, where Bamboo found the test failures, or too old are skipped
+    for _, buildKey := range []string{"CRAB-CWS145-7", "CRAB-CWS146-12", "CRAB-CWS147-2"} {
+        if len(bamboo.comments[buildKey]) > 0 {
+            t.Errorf("expected no comment on %s", buildKey)
+        }
+    }
+
+    assertEquals(t, stats.branchNamesToLastGoodCommits["release/R22.0.43"], "abc123")
+
+    // The malformed link doesn't stop the other builds from being processed
+    if len(stats.failures) != 1 {
+        t.Fatalf("expected 1 failure but found %d", len(stats.failures))
+    }
+    assertEquals(t, stats.failures[0].Link, "https://bamboo.example.com/browse/not-a-build")
+    if stats.counts["scanned"] != 6 || stats.counts["skipped"] != 4 || stats.counts["commented"] != 1 || stats.counts["failed"] != 1 {
+        t.Errorf("unexpected counts: %v", stats.counts)
+    }
+}
+
+func TestHandleAllBuildsRecordsFailures(t *testing.T) {
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: time.Now()},
+    }
+    bamboo.errors["GetLabels"] = &RequestError{Service: bambooService, Operation: "get labels", Url: "labels", StatusCode: 503}
+
+    stats, err := handleAllBuilds(bamboo, testRules, nil, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 2 {
+        t.Errorf("expected both builds to fail, but %d did", len(stats.failures))
+    }
+
+    // If the activity stream can't be read, nothing can be scanned
+    bamboo.errors["ListRecentResults"] = &RequestError{Service: bambooService, Operation: "read the activity stream", Url: "streams", StatusCode: 500}
+    _, err = handleAllBuilds(bamboo, testRules, nil, nil, defaultWorkers, nil)
+    if err == nil {
+        t.Errorf("expected an error")
+    }
+}
+
+// Every failed job is scanned, and findings are attributed to their job
+func TestScanBuildScansEveryFailedJob(t *testing.T) {
+    bamboo := newFakeBamboo()
+    result := BambooResult{Stages: []BambooStage{{Name: "Build", Results: make([]BambooJobResult, 3)}}}
+    result.Stages[0].Results[0].Key = "CRAB-CWS144-JOB1-33"
+    result.Stages[0].Results[0].State = "Successful"
+    result.Stages[0].Results[1].Key = "CRAB-CWS144-JOB2-33"
+    result.Stages[0].Results[1].State = "Failed"
+    result.Stages[0].Results[1].Job.ShortName = ".NET"
+    result.Stages[0].Results[2].Key = "CRAB-CWS144-JOB3-33"
+    result.Stages[0].Results[2].State = "Failed"
+    result.Stages[0].Results[2].Job.ShortName = "Python"
+    bamboo.results["CRAB-CWS144-33"] = result
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    bamboo.logs["CRAB-CWS144-JOB2-33"] = readFileToString("test_files/csharp-compiler-error.log")
+    bamboo.logs["CRAB-CWS144-JOB3-33"] = readFileToString("test_files/python-pytest.log")
+
+    scanResult, err := scanBuild(bamboo, result, "CRAB-CWS144", "33", testRules)
+    if err != nil {
+        t.Fatal(err)
+    }
+    jobs := make(map[string]string)
+    for _, finding := range scanResult.Findings {
+        jobs[finding.RuleName] = finding.JobName
+    }
+    assertEquals(t, jobs["csharp-compiler-error"], ".NET")
+    assertEquals(t, jobs["python-pytest"], "Python")
+    if _, present := jobs["generic-error"]; present {
+        t.Errorf("expected the successful job not to be scanned")
+    }
+}
+
+// Failed builds, one every interval, most recent first
+func recentFailures(count int, now time.Time, interval time.Duration) []RecentResult {
+    results := make([]RecentResult, count)
+    for idx := range results {
+        results[idx] = RecentResult{
+            Link:      "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-" + strconv.Itoa(count-idx),
+            Published: now.Add(-time.Duration(idx) * interval),
+        }
+    }
+    return results
+}
+
+func TestListRecentResultsReadsEveryPage(t *testing.T) {
+    now := time.Now()
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = recentFailures(250, now, time.Minute)
+
+    results, err := listRecentResults(bamboo, nil, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 250 {
+        t.Fatalf("expected 250 results but found %d", len(results))
+    }
+    assertEquals(t, results[0].Link, "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-250")
+    assertEquals(t, results[249].Link, "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-1")
+}
+
+func TestListRecentResultsStopsAtTheLookbackWindow(t *testing.T) {
+    now := time.Now()
+    bamboo := newFakeBamboo()
+    // The 169th build is more than a week old, so the second page is the last.
+    // Each page starts with the oldest build of the page before, so there are 199 builds in all.
+    bamboo.recentResults = recentFailures(300, now, time.Hour)
+
+    results, err := listRecentResults(bamboo, nil, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 199 {
+        t.Errorf("expected 199 results but found %d", len(results))
+    }
+}
+
+func TestListRecentResultsStopsAtARecordedBuild(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    err = store.RecordBuild(BuildRecord{Build: "CRAB-CWS144-150", Outcome: outcomeNoMatch})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    now := time.Now()
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = recentFailures(300, now, time.Minute)
+
+    // Build 150 is on the second page, which overlaps the first by one build
+    results, err := listRecentResults(bamboo, store, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 199 {
+        t.Errorf("expected 199 results but found %d", len(results))
+    }
+}
+
+func TestListRecentResultsStopsAtTheHighWaterMark(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    now := time.Now()
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = recentFailures(300, now, time.Minute)
+    for idx := range bamboo.recentResults {
+        bamboo.recentResults[idx].Successful = true
+    }
+    // Builds up to 120 were all processed by an earlier scan. Only build 120 itself is listed again.
+    err = store.RecordHighWaterMark(bamboo.recentResults[180].Published)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The mark never moves back
+    err = store.RecordHighWaterMark(bamboo.recentResults[250].Published)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    results, err := listRecentResults(bamboo, store, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 181 {
+        t.Fatalf("expected 181 results but found %d", len(results))
+    }
+    assertEquals(t, results[180].Link, "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-120")
+}
+
+func TestHighWaterMark(t *testing.T) {
+    now := time.Now()
+    results := recentFailures(5, now, time.Minute)
+    assertEquals(t, highWaterMark(results, nil).String(), now.String())
+    assertEquals(t, highWaterMark(nil, nil).String(), time.Time{}.String())
+
+    // Builds that couldn't be processed are tried again, so the mark stays before the oldest of them
+    failures := []BuildFailure{{Link: results[1].Link}, {Link: results[3].Link}}
+    assertEquals(t, highWaterMark(results, failures).String(), results[4].Published.String())
+}
+
+// Only failed builds have labels worth reading, and only the release plans' successful builds are looked up
+func TestSuccessfulBuildsNeedFewRequests(t *testing.T) {
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now(), Successful: true},
+    }
+    bamboo.errors["GetLabels"] = &RequestError{Service: bambooService, Operation: "get labels", Url: "labels", StatusCode: 503}
+    bamboo.errors["GetResult"] = &RequestError{Service: bambooService, Operation: "get result", Url: "result", StatusCode: 503}
+
+    stats, err := handleAllBuilds(bamboo, testRules, nil, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Errorf("expected no failures, but found %v", stats.failures)
+    }
+}
+
+// However the workers interleave, every build is handled exactly once
+func TestHandleAllBuildsConcurrently(t *testing.T) {
+    now := time.Now()
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = recentFailures(50, now, time.Minute)
+    for _, recentResult := range bamboo.recentResults {
+        buildKey, buildNumber, _ := parseBuildLink(recentResult.Link)
+        bamboo.logs[buildKey+"-JOB1-"+buildNumber] = readFileToString("test_files/generic.log")
+    }
+
+    stats, err := handleAllBuilds(bamboo, testRules, nil, nil, 8, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stats.counts["scanned"] != 50 || stats.counts["commented"] != 50 || stats.counts["failed"] != 0 {
+        t.Errorf("unexpected counts: %v", stats.counts)
+    }
+    for idx := 1; idx <= 50; idx++ {
+        build := "CRAB-CWS144-" + strconv.Itoa(idx)
+        if len(bamboo.comments[build]) != 1 || len(bamboo.labels[build]) != 1 {
+            t.Errorf("expected one comment and one label on %s", build)
+        }
+    }
+}
+
+// The last good commit is the one from the most recently published build, whichever is handled first
+func TestLastGoodCommitIsTheNewest(t *testing.T) {
+    now := time.Now()
+    stats := newScanStats()
+    stats.recordGoodCommit("release-R22.0.43", "older", now.Add(-time.Hour))
+    stats.recordGoodCommit("release-R22.0.43", "newer", now)
+    stats.recordGoodCommit("release-R22.0.43", "oldest", now.Add(-2*time.Hour))
+    assertEquals(t, stats.planNameToLastGoodCommit["release-R22.0.43"], "newer")
+    assertEquals(t, stats.branchNamesToLastGoodCommits["release/R22.0.43"], "newer")
+
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWO301-JOB1-6", Published: now, Successful: true},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWO301-JOB1-5", Published: now.Add(-time.Minute), Successful: true},
+    }
+    bamboo.results["CRAB-CWO301-6"] = BambooResult{PlanName: "release-R22.0.43", BuildState: "Successful", VcsRevisionKey: "def456"}
+    bamboo.results["CRAB-CWO301-5"] = BambooResult{PlanName: "release-R22.0.43", BuildState: "Successful", VcsRevisionKey: "abc123"}
+    stats, err := handleAllBuilds(bamboo, testRules, nil, nil, 2, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, stats.branchNamesToLastGoodCommits["release/R22.0.43"], "def456")
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// New issues are filed as bugs, unless BAMBOT_JIRA_ISSUE_TYPE says otherwise
+const defaultJiraIssueType = "Bug"
+
+// How many open issues to consider when searching for a fingerprint
+const jiraSearchResults = 10
+
+// JIRA limits the length of a description, so only the start of a long snippet goes into a new issue
+const maxJiraSnippetLines = 100
+
+// Issues filed by Bambot have this label
+const jiraLabel = "bambot"
+
+// Talks to a JIRA server over its REST API
+type JiraClient struct {
+	Url        string
+	HttpClient *http.Client
+	// Ex: "Basic ..." for a username and API token, or "Bearer ..." for a personal access token
+	AuthHeader string
+}
+
+func newJiraClient(jiraUrl string, httpClient *http.Client, authHeader string) *JiraClient {
+	return &JiraClient{Url: jiraUrl, HttpClient: httpClient, AuthHeader: authHeader}
+}
+
+// An issue in the results of a search, Ex: {"key": "CRAB-1234", "fields": {"project": {"key": "CRAB"}}}
+type JiraIssue struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Summary string `json:"summary"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"fields"`
+}
+
+// The link to an issue, for people to follow
+func (client *JiraClient) browseUrl(key string) string {
+	return client.Url + "/browse/" + key
+}
+
+// Send a request to JIRA, and read the whole response body.
+// It's an error if JIRA doesn't respond with a 2xx status code.
+func (client *JiraClient) sendRequest(method string, requestUrl string, body io.Reader, operation string) ([]byte, error) {
+	req, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, &RequestError{Service: jiraService, Operation: operation, Url: requestUrl, Err: err}
+	}
+	req.Header.Set("Authorization", client.AuthHeader)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return sendRequest(client.HttpClient, req, jiraService, operation)
+}
+
+// Find the issues matching a JQL query. The search is a GET, so it's retried like Bamboo's reads.
+func (client *JiraClient) SearchIssues(jql string, maxResults int) ([]JiraIssue, error) {
+	query := url.Values{}
+	query.Set("jql", jql)
+	query.Set("maxResults", strconv.Itoa(maxResults))
+	query.Set("fields", "summary,project")
+	searchUrl := client.Url + "/rest/api/2/search?" + query.Encode()
+	body, err := client.sendRequest("GET", searchUrl, nil, "search for issues")
+	if err != nil {
+		return nil, err
+	}
+	var results struct {
+		Issues []JiraIssue `json:"issues"`
+	}
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return nil, &RequestError{Service: jiraService, Operation: "search for issues", Url: searchUrl, Err: err}
+	}
+	return results.Issues, nil
+}
+
+// What a new issue says
+type jiraNewIssue struct {
+	// Ex: CRAB
+	Project     string
+	IssueType   string
+	Summary     string
+	Description string
+	Labels      []string
+}
+
+// File a new issue, and return its key, Ex: CRAB-1234
+func (client *JiraClient) CreateIssue(issue jiraNewIssue) (string, error) {
+	createUrl := client.Url + "/rest/api/2/issue"
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": issue.Project},
+		"issuetype":   map[string]string{"name": issue.IssueType},
+		"summary":     issue.Summary,
+		"description": issue.Description,
+		"labels":      issue.Labels,
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{"fields": fields})
+	if err != nil {
+		return "", &RequestError{Service: jiraService, Operation: "create an issue", Url: createUrl, Err: err}
+	}
+	body, err := client.sendRequest("POST", createUrl, bytes.NewReader(reqBody), "create an issue")
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	err = json.Unmarshal(body, &created)
+	if err != nil {
+		return "", &RequestError{Service: jiraService, Operation: "create an issue", Url: createUrl, Err: err}
+	}
+	if created.Key == "" {
+		return "", &RequestError{Service: jiraService, Operation: "create an issue", Url: createUrl, Message: "no key in the response"}
+	}
+	return created.Key, nil
+}
+
+// Links findings to the open JIRA issues that mention their fingerprint, and files an issue for a failure that
+// keeps coming back without one
+type jiraTracker struct {
+	client *JiraClient
+	// Where new issues are filed, Ex: CRAB. Issues in this project are preferred when several mention a fingerprint.
+	project   string
+	issueType string
+	// File an issue once a failure has been found in this many builds, or never if 0
+	createAfter int
+	// In a dry run, JIRA is searched but no issues are filed
+	dryRun bool
+
+	// Builds are handled concurrently, so issues are filed one at a time, and two builds with the same new failure
+	// don't both file one
+	mutex sync.Mutex
+	// The issues filed since Bambot started, by fingerprint
+	filed map[string]string
+}
+
+func newJiraTracker(client *JiraClient, project string, issueType string, createAfter int, dryRun bool) *jiraTracker {
+	return &jiraTracker{
+		client:      client,
+		project:     project,
+		issueType:   issueType,
+		createAfter: createAfter,
+		dryRun:      dryRun,
+		filed:       make(map[string]string),
+	}
+}
+
+// Issues mentioning the fingerprint that haven't been resolved yet, most recently updated first
+func fingerprintJql(fingerprint string) string {
+	return `description ~ "` + fingerprint + `" AND resolution = Unresolved ORDER BY updated DESC`
+}
+
+// The best open issue for a fingerprint: the most recently updated one in the project, or else anywhere
+func (tracker *jiraTracker) findIssue(fingerprint string) (JiraIssue, bool, error) {
+	issues, err := tracker.client.SearchIssues(fingerprintJql(fingerprint), jiraSearchResults)
+	if err != nil || len(issues) == 0 {
+		return JiraIssue{}, false, err
+	}
+	for _, issue := range issues {
+		if issue.Fields.Project.Key == tracker.project {
+			return issue, true, nil
+		}
+	}
+	return issues[0], true, nil
+}
+
+// Link each finding that isn't a known issue to the best open issue for its fingerprint. When there's none, and the
+// failure has been found in enough builds, file one. The occurrences of each fingerprint come from the store.
+// JIRA being unavailable doesn't stop the build from being commented on, so problems are only written to output.
+func (tracker *jiraTracker) linkFindings(findings []Finding, link string, occurrences map[string]FingerprintRecord, store *Store, output io.Writer) {
+	for idx := range findings {
+		finding := &findings[idx]
+		if finding.JiraIssueId != "" {
+			continue
+		}
+		issue, found, err := tracker.findIssue(finding.Fingerprint)
+		if err != nil {
+			fmt.Fprint(output, "Couldn't search JIRA: ", err, " ... ")
+			continue
+		}
+		if found {
+			fmt.Fprint(output, "Found JIRA issue ", issue.Key, " ... ")
+			finding.JiraIssueId = issue.Key
+			finding.JiraIssueLink = tracker.client.browseUrl(issue.Key)
+			continue
+		}
+
+		tracker.fileIssue(finding, link, occurrences[finding.Fingerprint], store, output)
+	}
+}
+
+// File an issue for a failure that's been found in enough builds, unless Bambot already filed one. An issue Bambot
+// filed that's since been resolved isn't filed again.
+func (tracker *jiraTracker) fileIssue(finding *Finding, link string, record FingerprintRecord, store *Store, output io.Writer) {
+	if tracker.createAfter <= 0 || tracker.project == "" || len(record.Builds) < tracker.createAfter {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if record.FiledIssue != "" || tracker.filed[finding.Fingerprint] != "" {
+		return
+	}
+	if tracker.dryRun {
+		fmt.Fprint(output, "Would file a JIRA issue for ", finding.Fingerprint, " ... ")
+		return
+	}
+	key, err := tracker.client.CreateIssue(tracker.newIssue(*finding, link, len(record.Builds)))
+	if err != nil {
+		fmt.Fprint(output, "Couldn't file a JIRA issue: ", err, " ... ")
+		return
+	}
+	fmt.Fprint(output, "Filed JIRA issue ", key, " ... ")
+	tracker.filed[finding.Fingerprint] = key
+	finding.JiraIssueId = key
+	finding.JiraIssueLink = tracker.client.browseUrl(key)
+	if store != nil {
+		err = store.RecordFiledIssue(finding.Fingerprint, key)
+		if err != nil {
+			fmt.Fprint(output, "Couldn't remember JIRA issue ", key, ": ", err, " ... ")
+		}
+	}
+}
+
+// The issue for a failure, which includes its fingerprint so that future searches find it
+func (tracker *jiraTracker) newIssue(finding Finding, link string, builds int) jiraNewIssue {
+	summary := truncateLine(strings.SplitN(finding.Comment, "\n", 2)[0], 200)
+	description := fmt.Sprintf("Bambot has found this failure in %d builds, most recently %s\n\n", builds, link)
+	description += finding.Comment + "\n\n"
+	if finding.Job != "" {
+		description += "In job " + finding.JobName + " (" + finding.Job + ")\n\n"
+	}
+	description += "{noformat}\n" + truncateLines(finding.LogSnippet, maxSnippetWidth, maxJiraSnippetLines) + "\n{noformat}\n\n"
+	description += "Bambot fingerprint: " + finding.Fingerprint
+	return jiraNewIssue{
+		Project:     tracker.project,
+		IssueType:   tracker.issueType,
+		Summary:     summary,
+		Description: description,
+		Labels:      []string{jiraLabel},
+	}
+}
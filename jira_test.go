@@ -0,0 +1,170 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// The fingerprint of the finding in generic.log
+func genericLogFingerprint() string {
+    return scanString(readFileToString("test_files/generic.log"), testRules).Findings[0].Fingerprint
+}
+
+func TestJiraLinksTheBestOpenIssue(t *testing.T) {
+    jira := newFakeJiraServer()
+    defer jira.Close()
+    fingerprint := genericLogFingerprint()
+    // Listed oldest first: only the open issue in the project is linked
+    jira.addIssue(fakeJiraIssue{key: "CRAB-2", project: "CRAB", description: "Bambot fingerprint: " + fingerprint})
+    jira.addIssue(fakeJiraIssue{key: "CRAB-1", project: "CRAB", description: "Bambot fingerprint: " + fingerprint, resolved: true})
+    jira.addIssue(fakeJiraIssue{key: "OPS-7", project: "OPS", description: "Also seen here: " + fingerprint})
+    jira.addIssue(fakeJiraIssue{key: "CRAB-3", project: "CRAB", description: "Something else entirely"})
+
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{{Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()}}
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    integrations := &Integrations{jira: jira.newTracker("CRAB", 0)}
+    _, err := handleAllBuilds(bamboo, testRules, nil, integrations, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertContains(t, bamboo.comments["CRAB-CWS144-33"][0], "This is a known issue in JIRA: CRAB-2 ("+jira.URL+"/browse/CRAB-2)")
+    assertEquals(t, fmt.Sprint(jira.recordedSearches()), "["+fingerprintJql(fingerprint)+"]")
+
+    // Without an issue in the project, the most recently updated one anywhere is linked
+    tracker := jira.newTracker("ELSEWHERE", 0)
+    findings := []Finding{{Fingerprint: fingerprint}}
+    tracker.linkFindings(findings, "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", nil, nil, ioutil.Discard)
+    assertEquals(t, findings[0].JiraIssueId, "OPS-7")
+
+    // Known issues from the rules file aren't searched for
+    findings = []Finding{{Fingerprint: fingerprint, JiraIssueId: "CRAB-1234"}}
+    tracker.linkFindings(findings, "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", nil, nil, ioutil.Discard)
+    assertEquals(t, findings[0].JiraIssueId, "CRAB-1234")
+    if len(jira.recordedSearches()) != 2 {
+        t.Errorf("expected 2 searches but found %d", len(jira.recordedSearches()))
+    }
+}
+
+func TestJiraFilesAnIssueForARecurringFailure(t *testing.T) {
+    jira := newFakeJiraServer()
+    defer jira.Close()
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    // Handled one at a time, newest first
+    bamboo := newFakeBamboo()
+    now := time.Now()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS146-JOB1-12", Published: now},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: now.Add(-time.Minute)},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: now.Add(-2 * time.Minute)},
+    }
+    for _, job := range []string{"CRAB-CWS144-JOB1-33", "CRAB-CWS145-JOB1-7", "CRAB-CWS146-JOB1-12"} {
+        bamboo.logs[job] = readFileToString("test_files/generic.log")
+    }
+
+    integrations := &Integrations{jira: jira.newTracker("CRAB", 2)}
+    stats, err := handleAllBuilds(bamboo, testRules, store, integrations, 1, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Fatalf("expected no failures, but found %v", stats.failures)
+    }
+
+    // The first time, there's no issue yet. The second time, Bambot files one, and the third time JIRA finds it.
+    assertNotContains(t, bamboo.comments["CRAB-CWS146-12"][0], "JIRA")
+    assertContains(t, bamboo.comments["CRAB-CWS145-7"][0], "This is a known issue in JIRA: CRAB-100 ("+jira.URL+"/browse/CRAB-100)")
+    assertContains(t, bamboo.comments["CRAB-CWS144-33"][0], "This is a known issue in JIRA: CRAB-100")
+
+    created := jira.createdIssues()
+    if len(created) != 1 {
+        t.Fatalf("expected 1 issue to be filed, but %d were", len(created))
+    }
+    fingerprint := genericLogFingerprint()
+    assertEquals(t, created[0].summary, "Bambot detected an error!")
+    assertEquals(t, created[0].issueType, "Bug")
+    assertEquals(t, fmt.Sprint(created[0].labels), "[bambot]")
+    assertContains(t, created[0].description, "Bambot has found this failure in 2 builds, most recently https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7")
+    assertContains(t, created[0].description, "{noformat}\n")
+    assertContains(t, created[0].description, "Timed out waiting for Seeq Server to become responsive.")
+    assertContains(t, created[0].description, "Bambot fingerprint: "+fingerprint)
+
+    record, found, err := store.GetFingerprint(fingerprint)
+    if err != nil || !found {
+        t.Fatalf("expected to find %s, but found=%v err=%v", fingerprint, found, err)
+    }
+    assertEquals(t, fmt.Sprint(record.Builds), "[CRAB-CWS146-12 CRAB-CWS145-7 CRAB-CWS144-33]")
+    assertEquals(t, record.FiledIssue, "CRAB-100")
+
+    // Once the issue is resolved, it isn't filed again
+    jira.mutex.Lock()
+    jira.issues[0].resolved = true
+    jira.mutex.Unlock()
+    tracker := jira.newTracker("CRAB", 2)
+    findings := []Finding{{Fingerprint: fingerprint}}
+    tracker.linkFindings(findings, "https://bamboo.example.com/browse/CRAB-CWS147-JOB1-2", map[string]FingerprintRecord{fingerprint: record}, store, ioutil.Discard)
+    assertEquals(t, findings[0].JiraIssueId, "")
+    if len(jira.createdIssues()) != 1 {
+        t.Errorf("expected no more issues to be filed")
+    }
+}
+
+func TestJiraDryRunDoesntFileIssues(t *testing.T) {
+    jira := newFakeJiraServer()
+    defer jira.Close()
+    tracker := jira.newTracker("CRAB", 1)
+    tracker.dryRun = true
+
+    fingerprint := genericLogFingerprint()
+    findings := []Finding{{Fingerprint: fingerprint, Comment: "Bambot detected an error!"}}
+    occurrences := map[string]FingerprintRecord{fingerprint: {Fingerprint: fingerprint, Builds: []string{"CRAB-CWS144-33"}}}
+    var output strings.Builder
+    tracker.linkFindings(findings, "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", occurrences, nil, &output)
+    assertEquals(t, output.String(), "Would file a JIRA issue for "+fingerprint+" ... ")
+    assertEquals(t, findings[0].JiraIssueId, "")
+    if len(jira.createdIssues()) != 0 {
+        t.Errorf("expected no issues to be filed in a dry run")
+    }
+}
+
+// JIRA being down doesn't stop Bambot from commenting on the build
+func TestJiraUnavailable(t *testing.T) {
+    jira := newFakeJiraServer()
+    defer jira.Close()
+    jira.setFailWith(503)
+
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{{Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()}}
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    integrations := &Integrations{jira: jira.newTracker("CRAB", 1)}
+    stats, err := handleAllBuilds(bamboo, testRules, nil, integrations, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Errorf("expected no failures, but found %v", stats.failures)
+    }
+    if len(bamboo.comments["CRAB-CWS144-33"]) != 1 {
+        t.Fatalf("expected a comment on CRAB-CWS144-33")
+    }
+    assertNotContains(t, bamboo.comments["CRAB-CWS144-33"][0], "JIRA")
+
+    _, err = jira.newTracker("CRAB", 1).client.SearchIssues(fingerprintJql("3f786850e387550f"), jiraSearchResults)
+    if jiraErr, ok := err.(*RequestError); !ok || jiraErr.Service != jiraService || jiraErr.StatusCode != 503 {
+        t.Errorf("expected a JIRA error with status code 503, but got '%v'", err)
+    }
+}
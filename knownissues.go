@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+)
+
+// A failure that's already tracked in JIRA, recognized by its snippet after a rule has found it
+type KnownIssue struct {
+	// Ex: CRAB-1234
+	JiraIssueId string `json:"jiraIssueId"`
+	// A regular expression the snippet must match, or the fingerprint of the snippet (see the scan command), or both
+	Pattern     string `json:"pattern,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Only findings of this rule are linked, if set
+	Rule string `json:"rule,omitempty"`
+	// What the issue is, for whoever reads the rules file
+	Description string `json:"description,omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+func (issue *KnownIssue) compile() error {
+	if issue.JiraIssueId == "" {
+		return errors.New("every known issue needs a jiraIssueId")
+	}
+	if issue.Pattern == "" && issue.Fingerprint == "" {
+		return errors.New("known issue " + issue.JiraIssueId + " needs a pattern or a fingerprint")
+	}
+	issue.regexp = nil
+	if issue.Pattern != "" {
+		var err error
+		issue.regexp, err = regexp.Compile(issue.Pattern)
+		if err != nil {
+			return errors.New("known issue " + issue.JiraIssueId + " has an invalid pattern: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (issue *KnownIssue) matches(finding Finding) bool {
+	if issue.Rule != "" && issue.Rule != finding.RuleName {
+		return false
+	}
+	if issue.Fingerprint != "" && issue.Fingerprint != finding.Fingerprint {
+		return false
+	}
+	return issue.regexp == nil || issue.regexp.MatchString(finding.LogSnippet)
+}
+
+// Link each finding to the first known issue it matches, unless its rule already names a JIRA issue
+func (rules *RulesFile) linkKnownIssues(findings []Finding) []Finding {
+	for idx := range findings {
+		if findings[idx].JiraIssueId != "" {
+			continue
+		}
+		for _, issue := range rules.KnownIssues {
+			if issue.matches(findings[idx]) {
+				findings[idx].JiraIssueId = issue.JiraIssueId
+				break
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+const knownIssueLog = "Errors and Failures:\n1) Test Failure : HandlerTest.testTimeout\n   Test exceeded Timeout value of 20000ms\nCommitting...\n"
+
+func TestKnownIssuesByPattern(t *testing.T) {
+    rules, err := parseRules([]byte(`{
+        "rules": [
+            {"name": "test-failure", "start": "Errors and Failures:", "end": "Committing...", "comment": "Tests failed"},
+            {"name": "timeout", "start": "Test exceeded Timeout", "comment": "Timed out"}
+        ],
+        "knownIssues": [
+            {"jiraIssueId": "CRAB-1", "pattern": "SomeOtherTest"},
+            {"jiraIssueId": "CRAB-2", "pattern": "HandlerTest\\.\\w+\\s+Test exceeded Timeout", "rule": "test-failure"},
+            {"jiraIssueId": "CRAB-3", "pattern": "Timeout"}
+        ]
+    }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    scanResult := scanString(knownIssueLog+"Retrying: Test exceeded Timeout value again\n", rules)
+    if len(scanResult.Findings) != 2 {
+        t.Fatalf("expected 2 findings but found %d: %v", len(scanResult.Findings), scanResult.Findings)
+    }
+    // The first known issue that matches wins, as long as it's for the same rule
+    assertEquals(t, scanResult.Findings[0].JiraIssueId, "CRAB-2")
+    assertEquals(t, scanResult.Findings[1].JiraIssueId, "CRAB-3")
+}
+
+func TestKnownIssuesByFingerprint(t *testing.T) {
+    rules, err := parseRules([]byte(`{"rules": [
+        {"name": "test-failure", "start": "Errors and Failures:", "end": "Committing...", "comment": "Tests failed"}
+    ]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    finding := onlyFinding(t, scanString(knownIssueLog, rules))
+    if len(finding.Fingerprint) != fingerprintLength {
+        t.Fatalf("expected a fingerprint of %d characters, but got '%s'", fingerprintLength, finding.Fingerprint)
+    }
+
+    rules.KnownIssues = []KnownIssue{{JiraIssueId: "CRAB-4", Fingerprint: finding.Fingerprint}}
+    err = rules.KnownIssues[0].compile()
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The same failure, indented differently in another build
+    finding = onlyFinding(t, scanString(strings.Replace(knownIssueLog, "\n1)", "\n    1)", 1), rules))
+    assertEquals(t, finding.JiraIssueId, "CRAB-4")
+
+    // A different failure has a different fingerprint
+    finding = onlyFinding(t, scanString(strings.Replace(knownIssueLog, "testTimeout", "testRetry", 1), rules))
+    assertEquals(t, finding.JiraIssueId, "")
+}
+
+// A rule that names its own JIRA issue keeps it
+func TestRuleJiraIssueComesFirst(t *testing.T) {
+    rules, err := parseRules([]byte(`{
+        "rules": [{"name": "timeout", "start": "Test exceeded Timeout", "comment": "Timed out", "jiraIssueId": "CRAB-5"}],
+        "knownIssues": [{"jiraIssueId": "CRAB-6", "pattern": "Timeout"}]
+    }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    finding := onlyFinding(t, scanString(knownIssueLog, rules))
+    assertEquals(t, finding.JiraIssueId, "CRAB-5")
+}
+
+func TestInvalidKnownIssues(t *testing.T) {
+    for _, content := range []string{
+        `{"rules": [], "knownIssues": [{"pattern": "no issue"}]}`,
+        `{"rules": [], "knownIssues": [{"jiraIssueId": "CRAB-7"}]}`,
+        `{"rules": [], "knownIssues": [{"jiraIssueId": "CRAB-8", "pattern": "(unclosed"}]}`,
+    } {
+        if _, err := parseRules([]byte(content)); err == nil {
+            t.Errorf("expected an error for %s", content)
+        }
+    }
+}
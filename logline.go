@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// The format of the timestamps Bamboo puts at the start of every log line
+const logTimestampFormat = "02-Jan-2006 15:04:05"
+
+// One line of a Bamboo build log, split into its parts
+type LogLine struct {
+	// Which stream the line came from: "build", "simple", "error", "command", etc.
+	// Empty if the line didn't have the usual Bamboo prefix.
+	Stream string
+	// Zero if the line didn't have a timestamp
+	Timestamp time.Time
+	// The text of the line, without the Bamboo prefix
+	Message string
+}
+
+// Bamboo prefixes each line with the stream it came from and a timestamp, separated by tabs (or sometimes spaces).
+// Ex: "build	07-Jan-2020 07:31:47	Errors and Failures:"
+// This is called for every line of every log, so it avoids regular expressions.
+func parseLogLine(line string) LogLine {
+	line = strings.TrimSuffix(line, "\r")
+
+	streamEnd := strings.IndexAny(line, "\t ")
+	if streamEnd <= 0 || !isLowercaseWord(line[:streamEnd]) {
+		return LogLine{Message: line}
+	}
+	timestampEnd := streamEnd + 1 + len(logTimestampFormat)
+	if len(line) < timestampEnd {
+		return LogLine{Message: line}
+	}
+	timestamp, err := time.ParseInLocation(logTimestampFormat, line[streamEnd+1:timestampEnd], time.Local)
+	if err != nil {
+		return LogLine{Message: line}
+	}
+
+	message := ""
+	if len(line) > timestampEnd {
+		if line[timestampEnd] != '\t' && line[timestampEnd] != ' ' {
+			return LogLine{Message: line}
+		}
+		message = line[timestampEnd+1:]
+	}
+	return LogLine{Stream: line[:streamEnd], Timestamp: timestamp, Message: message}
+}
+
+func isLowercaseWord(word string) bool {
+	for _, c := range word {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Split a build log into lines, and parse each of them
+func parseLog(bodyStr string) []LogLine {
+	rawLines := strings.Split(bodyStr, "\n")
+	lines := make([]LogLine, len(rawLines))
+	for idx, rawLine := range rawLines {
+		lines[idx] = parseLogLine(rawLine)
+	}
+	return lines
+}
+
+// Render log lines without their Bamboo prefixes
+func messages(lines []LogLine) string {
+	var result strings.Builder
+	for idx, line := range lines {
+		result.WriteString(line.Message)
+		if idx < len(lines)-1 {
+			result.WriteString("\n")
+		}
+	}
+	return result.String()
+}
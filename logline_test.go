@@ -0,0 +1,44 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseLogLine(t *testing.T) {
+    line := parseLogLine("build\t02-Jan-2020 17:51:16\t***** ERROR *****")
+    assertEquals(t, line.Stream, "build")
+    assertEquals(t, line.Message, "***** ERROR *****")
+    assertEquals(t, line.Timestamp.Format(time.RFC3339), time.Date(2020, 1, 2, 17, 51, 16, 0, time.Local).Format(time.RFC3339))
+
+    // Some logs use spaces instead of tabs, and the indentation of the message should be kept
+    line = parseLogLine("build 07-Jan-2020 07:31:47    Errors and Failures:")
+    assertEquals(t, line.Stream, "build")
+    assertEquals(t, line.Message, "   Errors and Failures:")
+
+    line = parseLogLine("simple\t02-Jan-2020 17:51:16\tFinished task 'sq test' with result: Failed\r")
+    assertEquals(t, line.Stream, "simple")
+    assertEquals(t, line.Message, "Finished task 'sq test' with result: Failed")
+
+    // An empty message
+    line = parseLogLine("build 07-Jan-2020 07:31:47")
+    assertEquals(t, line.Stream, "build")
+    assertEquals(t, line.Message, "")
+
+    // Lines without a prefix are kept as they are
+    for _, text := range []string{"", "...", "error CS0103: oops", "build 99-Foo-2020 07:31:47 nope"} {
+        line = parseLogLine(text)
+        assertEquals(t, line.Stream, "")
+        assertEquals(t, line.Message, text)
+        if !line.Timestamp.IsZero() {
+            t.Errorf("expected no timestamp for '%s'", text)
+        }
+    }
+}
+
+func TestSnippetsDontIncludePrefixes(t *testing.T) {
+    finding := assertMatch(t, readFileToString("test_files/generic-multiple-matches.log"), "Bambot detected an error!")
+    assertEquals(t, finding.LogSnippet, "***** ERROR *****\n<this should be included>\nFinished task 'sq test' with result: Failed")
+    assertEquals(t, finding.Timestamp.Format(logTimestampFormat), "02-Jan-2020 17:52:16")
+    assertContains(t, buildComment(ScanResult{Findings: []Finding{finding}}), "Logged at 02-Jan-2020 17:52:16")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Matcher decides whether a single line of a build log is a start or end anchor for a rule
+type Matcher interface {
+	// Returns true if the line matches, along with any values captured from the line.
+	// Captures are keyed both by group number ("1") and, for named groups, by name.
+	MatchLine(line string) (map[string]string, bool)
+}
+
+// Matches any line containing a literal string
+type literalMatcher struct {
+	literal string
+}
+
+func (m literalMatcher) MatchLine(line string) (map[string]string, bool) {
+	return nil, strings.Contains(line, m.literal)
+}
+
+// Matches any line containing a match for a regular expression
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexMatcher) MatchLine(line string) (map[string]string, bool) {
+	submatches := m.re.FindStringSubmatch(line)
+	if submatches == nil {
+		return nil, false
+	}
+
+	captures := make(map[string]string)
+	for idx, name := range m.re.SubexpNames() {
+		if idx == 0 {
+			continue
+		}
+		captures[strconv.Itoa(idx)] = submatches[idx]
+		if name != "" {
+			captures[name] = submatches[idx]
+		}
+	}
+	return captures, true
+}
+
+func newMatcher(pattern string, isRegex bool) (Matcher, error) {
+	if !isRegex {
+		return literalMatcher{literal: pattern}, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regexMatcher{re: re}, nil
+}
+
+// Add captures to a map, without replacing values already present
+func mergeCaptures(into map[string]string, from map[string]string) map[string]string {
+	if len(from) == 0 {
+		return into
+	}
+	if into == nil {
+		into = make(map[string]string)
+	}
+	for key, value := range from {
+		if _, present := into[key]; !present {
+			into[key] = value
+		}
+	}
+	return into
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// The rules file used when BAMBOT_RULES_FILE isn't set
+const defaultRulesFile = "rules.json"
+
+// Snippets are truncated to this many lines, each no wider than this many characters
+const maxSnippetLines = 2000
+const maxSnippetWidth = 160
+
+// A Rule describes one known pattern of build failure. The log snippet runs from the last line matching Start
+// that comes before the last line matching End. If End is empty, the snippet is just the last line matching Start.
+type Rule struct {
+	Name  string `json:"name"`
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+	// If true, Start and End are regular expressions instead of literal strings
+	Regex bool `json:"regex,omitempty"`
+	// Lines of context to include before the start and after the end of the snippet
+	LinesBefore int `json:"linesBefore,omitempty"`
+	LinesAfter  int `json:"linesAfter,omitempty"`
+	// The comment may refer to regex capture groups like ${1} or ${name}
+	Comment     string `json:"comment"`
+	JiraIssueId string `json:"jiraIssueId,omitempty"`
+	// One of "error" (the default), "warning" or "info"
+	Severity string `json:"severity,omitempty"`
+	// Rules with a higher priority are listed first
+	Priority int `json:"priority"`
+
+	start Matcher
+	end   Matcher
+}
+
+// Everything in the rules file
+type RulesFile struct {
+	Rules []Rule `json:"rules"`
+	// Patterns for secrets to scrub from the snippets, on top of the built-in ones
+	Redactions []Redaction `json:"redactions,omitempty"`
+	// Failures already tracked in JIRA
+	KnownIssues []KnownIssue       `json:"knownIssues,omitempty"`
+	Fingerprint FingerprintOptions `json:"fingerprint,omitempty"`
+	// Where to post the failures in Slack, by plan
+	Slack SlackRouting `json:"slack,omitempty"`
+
+	// The built-in redactions, followed by the ones from the file
+	redactions []Redaction
+}
+
+// Read the failure rules from a JSON file, sorted so the highest priority rule comes first
+func loadRules(fileName string) (*RulesFile, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(content)
+}
+
+func parseRules(content []byte) (*RulesFile, error) {
+	var rulesFile RulesFile
+	err := json.Unmarshal(content, &rulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := rulesFile.Rules
+	for idx := range rules {
+		err = rules[idx].compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Rules with equal priority keep the order they have in the file
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+
+	rulesFile.redactions = builtInRedactions()
+	for idx := range rulesFile.Redactions {
+		err = rulesFile.Redactions[idx].compile()
+		if err != nil {
+			return nil, err
+		}
+		rulesFile.redactions = append(rulesFile.redactions, rulesFile.Redactions[idx])
+	}
+	for idx := range rulesFile.KnownIssues {
+		err = rulesFile.KnownIssues[idx].compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for idx := range rulesFile.Slack.Routes {
+		err = rulesFile.Slack.Routes[idx].compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &rulesFile, nil
+}
+
+// Once the rules have found the snippets: scrub their secrets, fingerprint them, and link them to known issues
+func (rules *RulesFile) finishFindings(findings []Finding) []Finding {
+	findings = rules.scrubFindings(findings)
+	for idx := range findings {
+		findings[idx].Fingerprint = fingerprint(findings[idx], rules.Fingerprint)
+	}
+	return rules.linkKnownIssues(findings)
+}
+
+// Validate a rule and build its matchers
+func (rule *Rule) compile() error {
+	if rule.Name == "" {
+		return errors.New("every rule needs a name")
+	}
+	if rule.Start == "" || rule.Comment == "" {
+		return errors.New("rule " + rule.Name + " needs a start and a comment")
+	}
+	if rule.LinesBefore < 0 || rule.LinesAfter < 0 {
+		return errors.New("rule " + rule.Name + " can't have a negative number of context lines")
+	}
+	switch rule.Severity {
+	case "":
+		rule.Severity = "error"
+	case "error", "warning", "info":
+	default:
+		return errors.New("rule " + rule.Name + " has an unknown severity: " + rule.Severity)
+	}
+
+	var err error
+	rule.start, err = newMatcher(rule.Start, rule.Regex)
+	if err != nil {
+		return errors.New("rule " + rule.Name + " has an invalid start: " + err.Error())
+	}
+	rule.end = nil
+	if rule.End != "" {
+		rule.end, err = newMatcher(rule.End, rule.Regex)
+		if err != nil {
+			return errors.New("rule " + rule.Name + " has an invalid end: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Find the portion of the log matching this rule, if any
+func (rule *Rule) match(lines []LogLine) (Finding, bool) {
+	var captures map[string]string
+
+	endIdx := len(lines) - 1
+	if rule.end != nil {
+		for ; endIdx >= 0; endIdx-- {
+			if endCaptures, ok := rule.end.MatchLine(lines[endIdx].Message); ok {
+				captures = endCaptures
+				break
+			}
+		}
+		if endIdx < 0 {
+			return Finding{}, false
+		}
+	}
+
+	startIdx := endIdx
+	for ; startIdx >= 0; startIdx-- {
+		if startCaptures, ok := rule.start.MatchLine(lines[startIdx].Message); ok {
+			// Values captured by the start take precedence over those captured by the end
+			captures = mergeCaptures(startCaptures, captures)
+			break
+		}
+	}
+	if startIdx < 0 {
+		return Finding{}, false
+	}
+	if rule.end == nil {
+		endIdx = startIdx
+	}
+
+	first := startIdx - rule.LinesBefore
+	if first < 0 {
+		first = 0
+	}
+	last := endIdx + rule.LinesAfter
+	if last > len(lines)-1 {
+		last = len(lines) - 1
+	}
+
+	// In case the snippet is huge in either dimension, truncate it
+	snippet := truncateLines(messages(lines[first:last+1]), maxSnippetWidth, maxSnippetLines)
+	return Finding{
+		RuleName:    rule.Name,
+		Comment:     rule.expandComment(captures),
+		LogSnippet:  snippet,
+		JiraIssueId: rule.JiraIssueId,
+		Severity:    rule.Severity,
+		Timestamp:   lines[startIdx].Timestamp,
+		firstLine:   first,
+		lastLine:    last,
+	}, true
+}
+
+func (rule *Rule) expandComment(captures map[string]string) string {
+	if len(captures) == 0 {
+		return rule.Comment
+	}
+	return os.Expand(rule.Comment, func(key string) string {
+		return captures[key]
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestRulesAreSortedByPriority(t *testing.T) {
+    rules, err := parseRules([]byte(`{"rules": [
+        {"name": "low", "start": "a", "end": "b", "comment": "Low", "priority": 1},
+        {"name": "high", "start": "a", "end": "b", "comment": "High", "priority": 5},
+        {"name": "low-too", "start": "a", "end": "b", "comment": "Low too", "priority": 1}
+    ]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, rules.Rules[0].Name, "high")
+    assertEquals(t, rules.Rules[1].Name, "low")
+    assertEquals(t, rules.Rules[2].Name, "low-too")
+}
+
+func TestInvalidRules(t *testing.T) {
+    invalidRules := []string{
+        `not json`,
+        `{"rules": [{"start": "a", "end": "b", "comment": "No name"}]}`,
+        `{"rules": [{"name": "no-comment", "start": "a", "end": "b"}]}`,
+        `{"rules": [{"name": "negative", "start": "a", "comment": "Negative", "linesBefore": -1}]}`,
+    }
+    for _, content := range invalidRules {
+        if _, err := parseRules([]byte(content)); err == nil {
+            t.Errorf("expected '%s' to be rejected", content)
+        }
+    }
+}
+
+func TestCustomRule(t *testing.T) {
+    rules, err := parseRules([]byte(`{"rules": [
+        {"name": "custom", "start": "BOOM", "end": "done", "comment": "Kaboom!", "jiraIssueId": "CRAB-123"}
+    ]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    finding := onlyFinding(t, scanString("ok\nBOOM\nsomething broke\ndone\n", rules))
+    assertEquals(t, finding.Comment, "Kaboom!")
+    assertEquals(t, finding.JiraIssueId, "CRAB-123")
+    assertContains(t, finding.LogSnippet, "something broke")
+}
+
+func TestRegexRuleWithContext(t *testing.T) {
+    rules, err := parseRules([]byte(`{"rules": [
+        {"name": "failed-header", "start": "^(\\w+) FAILED$", "regex": true, "linesAfter": 1, "comment": "${1} failed"}
+    ]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    finding := onlyFinding(t, scanString("before\nTests FAILED\nfirst line after\nsecond line after\n", rules))
+    assertEquals(t, finding.Comment, "Tests failed")
+    assertEquals(t, finding.LogSnippet, "Tests FAILED\nfirst line after")
+}
+
+func TestRegexRuleWithStartAndEnd(t *testing.T) {
+    rules, err := parseRules([]byte(`{"rules": [
+        {"name": "start-end", "start": "BEGIN (?P<step>\\w+)", "end": "END( with code (?P<code>\\d+))?", "regex": true,
+         "linesBefore": 1, "comment": "Step ${step} exited with ${code}"}
+    ]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    finding := onlyFinding(t, scanString("zero\none\nBEGIN compile\ntwo\nEND with code 3\nthree\n", rules))
+    assertEquals(t, finding.Comment, "Step compile exited with 3")
+    assertEquals(t, finding.LogSnippet, "one\nBEGIN compile\ntwo\nEND with code 3")
+}
+
+func TestInvalidRegexRule(t *testing.T) {
+    _, err := parseRules([]byte(`{"rules": [{"name": "bad", "start": "(unclosed", "regex": true, "comment": "Bad"}]}`))
+    if err == nil {
+        t.Errorf("expected an invalid regex to be rejected")
+    }
+}
+
+func onlyFinding(t *testing.T, scanResult ScanResult) Finding {
+    if len(scanResult.Findings) != 1 {
+        t.Fatalf("expected exactly one finding, but found %d", len(scanResult.Findings))
+    }
+    return scanResult.Findings[0]
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// Longer lines are cut short while streaming, so one enormous line can't use up all the memory
+const maxLineLength = 1024 * 1024
+
+// Scan a build log in a single pass, evaluating every rule at the same time.
+// This finds the same snippets as scanString, but memory use is bounded by the size of the snippets
+// (at most maxSnippetLines for each rule) rather than by the size of the log.
+func scanReader(reader io.Reader, rules *RulesFile) (ScanResult, error) {
+	states := make([]ruleState, len(rules.Rules))
+	maxLinesBefore := 0
+	for idx := range rules.Rules {
+		states[idx].rule = &rules.Rules[idx]
+		if rules.Rules[idx].LinesBefore > maxLinesBefore {
+			maxLinesBefore = rules.Rules[idx].LinesBefore
+		}
+	}
+	recentLines := newLineRing(maxLinesBefore)
+
+	bufferedReader := bufio.NewReader(reader)
+	for lineNumber := 0; ; lineNumber++ {
+		rawLine, readErr := readLine(bufferedReader)
+		if readErr != nil && readErr != io.EOF {
+			return nonMatch(), readErr
+		}
+
+		line := parseLogLine(rawLine)
+		for idx := range states {
+			states[idx].addLine(line, lineNumber, recentLines)
+		}
+		recentLines.push(line)
+
+		// Just like strings.Split, the text after the last newline counts as a line, even if it's empty
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	var findings []Finding
+	for idx := range states {
+		if finding, ok := states[idx].finish(); ok {
+			findings = append(findings, finding)
+		}
+	}
+	return ScanResult{Findings: rules.finishFindings(removeOverlappingFindings(findings))}, nil
+}
+
+// Read one line, without the trailing newline. Only the first maxLineLength bytes of a line are kept.
+func readLine(reader *bufio.Reader) (string, error) {
+	fragment, err := reader.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		// The usual case: the whole line fit in the buffer
+		return strings.TrimSuffix(string(fragment), "\n"), err
+	}
+
+	line := append([]byte(nil), fragment...)
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if len(line) < maxLineLength {
+			room := maxLineLength - len(line)
+			if len(fragment) > room {
+				fragment = fragment[:room]
+			}
+			line = append(line, fragment...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return strings.TrimSuffix(string(line), "\n"), err
+	}
+}
+
+// The lines of a (possibly incomplete) snippet
+type span struct {
+	// Only the first maxSnippetLines lines are kept, each truncated to maxSnippetWidth
+	lines []string
+	// The total number of lines, including any that weren't kept
+	count     int
+	firstLine int
+	lastLine  int
+	timestamp time.Time
+	captures  map[string]string
+}
+
+func (s *span) add(line LogLine, lineNumber int) {
+	if len(s.lines) < maxSnippetLines {
+		message := line.Message
+		if len(message) > maxSnippetWidth {
+			// Copy the truncated line, so the rest of a long line can be garbage collected
+			message = string([]byte(truncateLine(message, maxSnippetWidth)))
+		}
+		s.lines = append(s.lines, message)
+	}
+	s.count++
+	s.lastLine = lineNumber
+}
+
+// Copy the span, so it stops growing when the original does
+func (s *span) snapshot() *span {
+	copied := *s
+	copied.lines = s.lines[:len(s.lines):len(s.lines)]
+	return &copied
+}
+
+// The same text truncateLines would produce for these lines
+func (s *span) text() string {
+	text := strings.Join(s.lines, "\n")
+	if s.count > len(s.lines) {
+		text += "\n..."
+	}
+	return text
+}
+
+// Tracks the progress of one rule through the log
+type ruleState struct {
+	rule *Rule
+	// Lines since the most recent start
+	open *span
+	// A complete match, still waiting for its lines of context after the end
+	pending          *span
+	pendingRemaining int
+	// The most recent complete match
+	best *span
+}
+
+func (state *ruleState) addLine(line LogLine, lineNumber int, recentLines *lineRing) {
+	rule := state.rule
+
+	if state.pending != nil {
+		state.pending.add(line, lineNumber)
+		state.pendingRemaining--
+		if state.pendingRemaining == 0 {
+			state.best = state.pending
+			state.pending = nil
+		}
+	}
+
+	startCaptures, isStart := rule.start.MatchLine(line.Message)
+	if isStart {
+		// Later starts replace earlier ones, since the snippet begins at the last start before the end
+		before := recentLines.last(rule.LinesBefore)
+		state.open = &span{firstLine: lineNumber - len(before), timestamp: line.Timestamp, captures: startCaptures}
+		for idx, beforeLine := range before {
+			state.open.add(beforeLine, lineNumber-len(before)+idx)
+		}
+		state.open.add(line, lineNumber)
+	} else if state.open != nil {
+		state.open.add(line, lineNumber)
+	}
+	if state.open == nil {
+		return
+	}
+
+	var endCaptures map[string]string
+	isEnd := false
+	if rule.end == nil {
+		isEnd = isStart
+	} else {
+		endCaptures, isEnd = rule.end.MatchLine(line.Message)
+	}
+	if !isEnd {
+		return
+	}
+
+	// Later ends replace earlier ones, since the snippet ends at the last end
+	match := state.open.snapshot()
+	match.captures = mergeCaptures(mergeCaptures(nil, state.open.captures), endCaptures)
+	if rule.end == nil {
+		// Without an end, there's nothing more to look for until the next start
+		state.open = nil
+	}
+	if rule.LinesAfter == 0 {
+		state.best = match
+		state.pending = nil
+	} else {
+		state.pending = match
+		state.pendingRemaining = rule.LinesAfter
+	}
+}
+
+// Once the whole log has been read, return the rule's finding (if any)
+func (state *ruleState) finish() (Finding, bool) {
+	if state.pending != nil {
+		// The log ended before all the lines of context after the end were found
+		state.best = state.pending
+		state.pending = nil
+	}
+	if state.best == nil {
+		return Finding{}, false
+	}
+
+	rule := state.rule
+	return Finding{
+		RuleName:    rule.Name,
+		Comment:     rule.expandComment(state.best.captures),
+		LogSnippet:  state.best.text(),
+		JiraIssueId: rule.JiraIssueId,
+		Severity:    rule.Severity,
+		Timestamp:   state.best.timestamp,
+		firstLine:   state.best.firstLine,
+		lastLine:    state.best.lastLine,
+	}, true
+}
+
+// A ring buffer of the most recent lines of the log, used for the lines of context before a start
+type lineRing struct {
+	lines []LogLine
+	next  int
+	count int
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]LogLine, size)}
+}
+
+func (ring *lineRing) push(line LogLine) {
+	if len(ring.lines) == 0 {
+		return
+	}
+	ring.lines[ring.next] = line
+	ring.next = (ring.next + 1) % len(ring.lines)
+	if ring.count < len(ring.lines) {
+		ring.count++
+	}
+}
+
+// The n most recent lines, oldest first
+func (ring *lineRing) last(n int) []LogLine {
+	if n > ring.count {
+		n = ring.count
+	}
+	result := make([]LogLine, n)
+	for idx := 0; idx < n; idx++ {
+		result[idx] = ring.lines[(ring.next-n+idx+len(ring.lines))%len(ring.lines)]
+	}
+	return result
+}
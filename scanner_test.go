@@ -0,0 +1,147 @@
+package main
+
+import (
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// The streaming scanner should find exactly what scanString finds
+func TestScanReaderMatchesScanString(t *testing.T) {
+    fileNames, err := filepath.Glob("test_files/*.log")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, fileName := range fileNames {
+        assertSameScanResults(t, readFileToString(fileName), testRules)
+    }
+
+    contextRules, err := parseRules([]byte(`{"rules": [
+        {"name": "context", "start": "START", "end": "END", "linesBefore": 2, "linesAfter": 2, "comment": "Context"},
+        {"name": "no-end", "start": "^ALONE (\\d+)$", "regex": true, "linesBefore": 1, "linesAfter": 3, "comment": "Alone ${1}"}
+    ]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, bodyStr := range []string{
+        "",
+        "\n",
+        "START\nEND",
+        "START\nEND\n",
+        "a\nb\nc\nSTART\nd\nEND\ne\nf\ng",
+        "START\nEND\nSTART\nEND\nEND\nSTART\nx",
+        "a\nSTART\nb\nEND\nSTART\nc",
+        "ALONE 1\na\nALONE 2\nb",
+        "x\nALONE 1\nALONE 2\nALONE 3",
+    } {
+        assertSameScanResults(t, bodyStr, contextRules)
+    }
+}
+
+// Huge snippets are truncated the same way by both scanners
+func TestScanReaderTruncatesSnippets(t *testing.T) {
+    var log strings.Builder
+    log.WriteString("***** ERROR *****\n")
+    for idx := 0; idx < maxSnippetLines+10; idx++ {
+        log.WriteString(strings.Repeat("x", maxSnippetWidth+idx%3) + "\n")
+    }
+    log.WriteString("Finished task 'sq test' with result: Failed\n")
+
+    scanResult := assertSameScanResults(t, log.String(), testRules)
+    snippet := scanResult.Findings[0].LogSnippet
+    if !strings.HasSuffix(snippet, "\n...") {
+        t.Errorf("expected the snippet to end with an ellipsis")
+    }
+    if len(strings.Split(snippet, "\n")) != maxSnippetLines+1 {
+        t.Errorf("expected the snippet to have %d lines, plus the ellipsis", maxSnippetLines)
+    }
+}
+
+func TestLineRing(t *testing.T) {
+    ring := newLineRing(3)
+    assertEquals(t, messages(ring.last(2)), "")
+    ring.push(LogLine{Message: "a"})
+    ring.push(LogLine{Message: "b"})
+    assertEquals(t, messages(ring.last(5)), "a\nb")
+    ring.push(LogLine{Message: "c"})
+    ring.push(LogLine{Message: "d"})
+    assertEquals(t, messages(ring.last(3)), "b\nc\nd")
+    assertEquals(t, messages(ring.last(1)), "d")
+
+    // A ring with no room never has anything in it
+    empty := newLineRing(0)
+    empty.push(LogLine{Message: "a"})
+    assertEquals(t, messages(empty.last(1)), "")
+}
+
+func assertSameScanResults(t *testing.T, bodyStr string, rules *RulesFile) ScanResult {
+    expected := scanString(bodyStr, rules)
+    actual, err := scanReader(strings.NewReader(bodyStr), rules)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(actual, expected) {
+        t.Errorf("for '%s', expected scanReader to find %v but it found %v", truncate(bodyStr), expected, actual)
+    }
+    return actual
+}
+
+// A large log, with failures scattered throughout
+func largeFailingLog() string {
+    var log strings.Builder
+    fixtures := []string{
+        readFileToString("test_files/generic.log"),
+        readFileToString("test_files/csharp-compiler-error.log"),
+        readFileToString("test_files/python-pytest.log"),
+        readFileToString("test_files/grunt-1.log"),
+    }
+    filler := "build\t02-Jan-2020 17:47:16\t[INFO] Compiling 42 source files to /build/target/classes\n"
+    for idx := 0; idx < 200; idx++ {
+        log.WriteString(strings.Repeat(filler, 500))
+        log.WriteString(fixtures[idx%len(fixtures)])
+        log.WriteString("\n")
+    }
+    return log.String()
+}
+
+// A large log that doesn't match any rule, so every rule has to look at every line
+func largePassingLog() string {
+    filler := "build\t02-Jan-2020 17:47:16\t[INFO] Compiling 42 source files to /build/target/classes\n"
+    return strings.Repeat(filler, 100000)
+}
+
+func BenchmarkScanStringFailingLog(b *testing.B) {
+    benchmarkScanString(b, largeFailingLog())
+}
+
+func BenchmarkScanReaderFailingLog(b *testing.B) {
+    benchmarkScanReader(b, largeFailingLog())
+}
+
+func BenchmarkScanStringPassingLog(b *testing.B) {
+    benchmarkScanString(b, largePassingLog())
+}
+
+func BenchmarkScanReaderPassingLog(b *testing.B) {
+    benchmarkScanReader(b, largePassingLog())
+}
+
+func benchmarkScanString(b *testing.B, bodyStr string) {
+    b.SetBytes(int64(len(bodyStr)))
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        scanString(bodyStr, testRules)
+    }
+}
+
+func benchmarkScanReader(b *testing.B, bodyStr string) {
+    b.SetBytes(int64(len(bodyStr)))
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        _, err := scanReader(strings.NewReader(bodyStr), testRules)
+        if err != nil {
+            b.Fatal(err)
+        }
+    }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+)
+
+// What a secret in a snippet is replaced with
+const scrubbed = "[REDACTED]"
+
+// Words at least this long, made of letters, digits and symbols that appear in keys, might be random secrets
+const minHighEntropyLength = 20
+
+// Random secrets have at least this many bits of entropy per character. English words and identifiers have less.
+const minHighEntropyBits = 4.0
+
+// A pattern for secrets that logs sometimes echo, which must not be posted to Bamboo.
+// If the pattern has groups, only the text they capture is scrubbed, Ex: "password=(\S+)" keeps "password=".
+type Redaction struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	regexp *regexp.Regexp
+}
+
+func (redaction *Redaction) compile() error {
+	if redaction.Name == "" || redaction.Pattern == "" {
+		return errors.New("every redaction needs a name and a pattern")
+	}
+	var err error
+	redaction.regexp, err = regexp.Compile(redaction.Pattern)
+	if err != nil {
+		return errors.New("redaction " + redaction.Name + " has an invalid pattern: " + err.Error())
+	}
+	return nil
+}
+
+// The secrets Bambot always scrubs: the ones it redacts from its own output, and a few more
+func builtInRedactions() []Redaction {
+	redactions := []Redaction{
+		{Name: "aws-access-key-id", regexp: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		{Name: "aws-secret-access-key", regexp: regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`)},
+	}
+	redactions = append(redactions, secretDetectors...)
+	return append(redactions, Redaction{Name: "connection-string-password", regexp: regexp.MustCompile(`(?i)\b(?:password|pwd)\s*=\s*([^;\s'"]+)`)})
+}
+
+// Scrub the secrets from the comment and snippet of each finding
+func (rules *RulesFile) scrubFindings(findings []Finding) []Finding {
+	for idx := range findings {
+		findings[idx].Comment = scrubSecrets(findings[idx].Comment, rules.redactions)
+		findings[idx].LogSnippet = scrubSecrets(findings[idx].LogSnippet, rules.redactions)
+	}
+	return findings
+}
+
+// Replace everything that looks like a secret with [REDACTED]
+func scrubSecrets(text string, redactions []Redaction) string {
+	for _, redaction := range redactions {
+		text = replaceMatches(text, redaction.regexp, scrubbed)
+	}
+	return scrubHighEntropyWords(text)
+}
+
+// Replace each match of a pattern with the placeholder, or only its groups if it has any
+func replaceMatches(text string, pattern *regexp.Regexp, placeholder string) string {
+	matches := pattern.FindAllStringSubmatchIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+
+	result := ""
+	last := 0
+	for _, match := range matches {
+		// Pairs of indexes: the whole match, then each group
+		spans := match[2:]
+		if len(spans) == 0 {
+			spans = match[:2]
+		}
+		for idx := 0; idx < len(spans); idx += 2 {
+			start, end := spans[idx], spans[idx+1]
+			// Groups that didn't participate in the match, or that overlap one already scrubbed, are skipped
+			if start < 0 || start < last {
+				continue
+			}
+			result += text[last:start] + placeholder
+			last = end
+		}
+	}
+	return result + text[last:]
+}
+
+// Random-looking words, like API keys and tokens: long, mixing upper and lower case letters and digits
+var candidateWordRegexp = regexp.MustCompile(`[A-Za-z0-9+/_-]{20,}={0,2}`)
+
+func scrubHighEntropyWords(text string) string {
+	return candidateWordRegexp.ReplaceAllStringFunc(text, func(word string) string {
+		if isHighEntropy(word) {
+			return scrubbed
+		}
+		return word
+	})
+}
+
+func isHighEntropy(word string) bool {
+	if len(word) < minHighEntropyLength {
+		return false
+	}
+	hasUpper, hasLower, hasDigit := false, false, false
+	counts := make(map[rune]int)
+	for _, char := range word {
+		switch {
+		case 'A' <= char && char <= 'Z':
+			hasUpper = true
+		case 'a' <= char && char <= 'z':
+			hasLower = true
+		case '0' <= char && char <= '9':
+			hasDigit = true
+		}
+		counts[char]++
+	}
+	// Hashes (lower case hex), GUIDs and identifiers like DefaultConcurrentRequestsHandlerTest don't mix all three
+	if !hasUpper || !hasLower || !hasDigit {
+		return false
+	}
+	return shannonEntropy(counts, len(word)) >= minHighEntropyBits
+}
+
+// The average number of bits per character
+func shannonEntropy(counts map[rune]int, length int) float64 {
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(length)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
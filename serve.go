@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the daemon polls the activity stream, unless BAMBOT_INTERVAL says otherwise
+const defaultInterval = 5 * time.Minute
+
+// The most extra time the daemon waits between polls, unless BAMBOT_JITTER says otherwise.
+// Spreading out the polls keeps several Bambots from hitting Bamboo at the same moment.
+const defaultJitter = 30 * time.Second
+
+// Keep scanning the activity stream until SIGTERM (or Ctrl-C), which stops Bambot once the build being
+// processed is finished
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	rulesFile := flags.String("rules", rulesFileFromEnv(), "the rules file")
+	storeFile := flags.String("store", storeFileFromEnv(), "the file where Bambot remembers the builds it has processed")
+	interval := flags.Duration("interval", durationFromEnv("BAMBOT_INTERVAL", defaultInterval), "how often to poll the activity stream")
+	jitter := flags.Duration("jitter", durationFromEnv("BAMBOT_JITTER", defaultJitter), "the most extra time to wait between polls")
+	workers := flags.Int("workers", intFromEnv("BAMBOT_WORKERS", defaultWorkers), "how many builds to process at the same time")
+	httpOptions := addHttpFlags(flags)
+	jiraCreateAfter := flags.Int("jira-create-after", intFromEnv("BAMBOT_JIRA_CREATE_AFTER", 0), "file a JIRA issue for a failure once it's been found in this many builds, or never if 0")
+	listen := flags.String("listen", os.Getenv("BAMBOT_LISTEN"), "the address to receive Bamboo webhooks on, Ex: :8080")
+	_ = flags.Parse(args)
+
+	webhookSecret := secretFromEnvOrExit("BAMBOT_WEBHOOK_SECRET")
+	if *listen != "" && webhookSecret == "" {
+		exitWithError("Missing BAMBOT_WEBHOOK_SECRET environment variable, which is needed to receive webhooks")
+	}
+	addSecretOrExit("BAMBOT_WEBHOOK_SECRET", webhookSecret)
+
+	creds := credentialsFromEnv()
+	rules, err := loadRules(*rulesFile)
+	if err != nil {
+		exitWithError("Failed to load rules from " + *rulesFile + ": " + err.Error())
+	}
+	integrations := &Integrations{
+		jira:  jiraTrackerFromEnv(*jiraCreateAfter, false, httpOptions),
+		slack: slackNotifierFromEnv(rules.Slack, false, httpOptions),
+	}
+	store, err := openStore(*storeFile)
+	if err != nil {
+		exitWithError("Failed to open the store " + *storeFile + ": " + err.Error())
+	}
+	defer store.Close()
+
+	client := newBambooClient(creds.bambooUrl, newHttpClient(httpOptions))
+	err = creds.logIn(client)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		fmt.Println("\nReceived", sig, "- stopping after the current build")
+		close(stop)
+	}()
+
+	// Builds from webhooks are scanned one at a time, alongside the scans of the activity stream
+	var queue chan webhookBuild
+	if *listen != "" {
+		queue = make(chan webhookBuild, webhookQueueSize)
+		mux := http.NewServeMux()
+		mux.Handle("/webhook", newWebhookHandler(creds.bambooUrl, webhookSecret, queue))
+		server := &http.Server{Addr: *listen, Handler: mux}
+		go func() {
+			fmt.Println("Listening for webhooks on", *listen)
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				exitWithError("Failed to listen for webhooks: " + err.Error())
+			}
+		}()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_ = server.Shutdown(ctx)
+		}()
+	}
+
+	// A token doesn't expire like a session does
+	var bamboo Bamboo = client
+	if creds.token == "" {
+		bamboo = newSessionBamboo(client, creds.username, creds.password)
+	}
+
+	serve(bamboo, rules, store, integrations, *interval, *jitter, *workers, queue, stop)
+	fmt.Println("Stopped")
+}
+
+// Scan the activity stream every interval (plus up to jitter), and each build from the queue as soon as it arrives,
+// even in the middle of a scan, until stop is closed. A nil queue never has any builds.
+func serve(bamboo Bamboo, rules *RulesFile, store *Store, integrations *Integrations, interval time.Duration, jitter time.Duration, workers int, queue <-chan webhookBuild, stop <-chan struct{}) {
+	webhookDone := make(chan struct{})
+	go func() {
+		defer close(webhookDone)
+		for {
+			// Check for stop first, since select picks at random when a build is waiting too
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			select {
+			case <-stop:
+				return
+			case build := <-queue:
+				handleWebhookBuild(build, bamboo, rules, store, integrations)
+			}
+		}
+	}()
+	// The build from the webhook being processed is finished too
+	defer func() { <-webhookDone }()
+
+	for {
+		stats, err := handleAllBuilds(bamboo, rules, store, integrations, workers, stop)
+		if err != nil {
+			// Bamboo might be down for a moment, so try again next time
+			fmt.Println("Scan failed:", redact(err.Error()))
+		} else {
+			for _, failure := range stats.failures {
+				fmt.Println("Failed to process", failure.Link, ":", redact(failure.Err.Error()))
+			}
+			err = writeStringToFile("branchNamesToLastGoodCommits.txt", mapToText(stats.branchNamesToLastGoodCommits))
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		delay := nextDelay(interval, jitter)
+		fmt.Println("Next scan in", delay)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func nextDelay(interval time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// Wraps a BambooClient, logging in again whenever the session expires, so a long-running Bambot stays logged in
+type sessionBamboo struct {
+	client   *BambooClient
+	username string
+	password string
+	// Only one worker logs in at a time
+	loginMutex sync.Mutex
+}
+
+func newSessionBamboo(client *BambooClient, username string, password string) *sessionBamboo {
+	return &sessionBamboo{client: client, username: username, password: password}
+}
+
+// Make a request, and if the session had expired, log in and make it again.
+// When several workers find the session expired, the first one logs in and the others use its new session.
+func (bamboo *sessionBamboo) retry(request func() error) error {
+	sessionId := bamboo.client.sessionId()
+	err := request()
+	if !isSessionExpired(err) {
+		return err
+	}
+	bamboo.loginMutex.Lock()
+	var loginErr error
+	if bamboo.client.sessionId() == sessionId {
+		fmt.Println("Session expired, logging in again")
+		loginErr = bamboo.client.LogIn(bamboo.username, bamboo.password)
+	}
+	bamboo.loginMutex.Unlock()
+	if loginErr != nil {
+		return loginErr
+	}
+	return request()
+}
+
+func (bamboo *sessionBamboo) ListRecentResults(maxResults int, before time.Time) ([]RecentResult, error) {
+	var results []RecentResult
+	err := bamboo.retry(func() error {
+		var err error
+		results, err = bamboo.client.ListRecentResults(maxResults, before)
+		return err
+	})
+	return results, err
+}
+
+func (bamboo *sessionBamboo) GetResult(buildKey string, buildNumber string) (BambooResult, error) {
+	var result BambooResult
+	err := bamboo.retry(func() error {
+		var err error
+		result, err = bamboo.client.GetResult(buildKey, buildNumber)
+		return err
+	})
+	return result, err
+}
+
+func (bamboo *sessionBamboo) GetLabels(buildKey string, buildNumber string) ([]string, error) {
+	var labels []string
+	err := bamboo.retry(func() error {
+		var err error
+		labels, err = bamboo.client.GetLabels(buildKey, buildNumber)
+		return err
+	})
+	return labels, err
+}
+
+func (bamboo *sessionBamboo) AddLabel(buildKey string, buildNumber string, label string) error {
+	return bamboo.retry(func() error {
+		return bamboo.client.AddLabel(buildKey, buildNumber, label)
+	})
+}
+
+func (bamboo *sessionBamboo) AddComment(buildKey string, buildNumber string, content string) error {
+	return bamboo.retry(func() error {
+		return bamboo.client.AddComment(buildKey, buildNumber, content)
+	})
+}
+
+func (bamboo *sessionBamboo) DownloadJobLog(job BambooJobResult) (io.ReadCloser, error) {
+	var jobLog io.ReadCloser
+	err := bamboo.retry(func() error {
+		var err error
+		jobLog, err = bamboo.client.DownloadJobLog(job)
+		return err
+	})
+	return jobLog, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestSessionBambooLogsInAgain(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+    server.addEntry("CRAB-CWS144-JOB1-33", time.Now(), "build.failed", "")
+
+    client := server.newClient()
+    err := client.LogIn(server.username, server.password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bamboo := newSessionBamboo(client, server.username, server.password)
+
+    server.expireSession("FEDCBA9876543210FEDCBA9876543210")
+    results, err := bamboo.ListRecentResults(100, time.Time{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 1 {
+        t.Errorf("expected 1 result but found %d", len(results))
+    }
+    assertEquals(t, client.JSessionId, "FEDCBA9876543210FEDCBA9876543210")
+
+    logins := 0
+    for _, request := range server.recordedRequests() {
+        if request == "POST /userlogin.action" {
+            logins++
+        }
+    }
+    if logins != 2 {
+        t.Errorf("expected to log in twice, but logged in %d times", logins)
+    }
+
+    // Other errors aren't retried
+    _, err = bamboo.GetResult("CRAB-CWS144", "33")
+    if bambooErr, ok := err.(*RequestError); !ok || bambooErr.StatusCode != 404 {
+        t.Errorf("expected a not found error, but got '%v'", err)
+    }
+}
+
+// A worker that finds the session expired after another worker already logged in again uses the new session
+func TestSessionBambooLogsInOnce(t *testing.T) {
+    server := newFakeBambooServer()
+    defer server.Close()
+    server.addEntry("CRAB-CWS144-JOB1-33", time.Now(), "build.failed", "")
+
+    client := server.newClient()
+    err := client.LogIn(server.username, server.password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bamboo := newSessionBamboo(client, server.username, server.password)
+
+    server.expireSession("FEDCBA9876543210FEDCBA9876543210")
+    attempts := 0
+    err = bamboo.retry(func() error {
+        attempts++
+        _, err := client.ListRecentResults(100, time.Time{})
+        if attempts == 1 {
+            // Another worker's request failed too, and it logged in first
+            loginErr := client.LogIn(server.username, server.password)
+            if loginErr != nil {
+                t.Fatal(loginErr)
+            }
+        }
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, fmt.Sprint(attempts), "2")
+
+    logins := 0
+    for _, request := range server.recordedRequests() {
+        if request == "POST /userlogin.action" {
+            logins++
+        }
+    }
+    if logins != 2 {
+        t.Errorf("expected to log in twice, but logged in %d times", logins)
+    }
+}
+
+// Stops as soon as the first log is downloaded, like a SIGTERM in the middle of a build
+type stoppingBamboo struct {
+    *fakeBamboo
+    stop chan struct{}
+}
+
+func (bamboo *stoppingBamboo) DownloadJobLog(job BambooJobResult) (io.ReadCloser, error) {
+    select {
+    case <-bamboo.stop:
+    default:
+        close(bamboo.stop)
+    }
+    return bamboo.fakeBamboo.DownloadJobLog(job)
+}
+
+func TestStoppingFinishesTheCurrentBuild(t *testing.T) {
+    bamboo := &stoppingBamboo{fakeBamboo: newFakeBamboo(), stop: make(chan struct{})}
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: time.Now()},
+    }
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    bamboo.logs["CRAB-CWS145-JOB1-7"] = readFileToString("test_files/generic.log")
+
+    stats, err := handleAllBuilds(bamboo, testRules, nil, nil, 1, bamboo.stop)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(bamboo.comments["CRAB-CWS144-33"]) != 1 || len(bamboo.labels["CRAB-CWS144-33"]) != 1 {
+        t.Errorf("expected the build in progress to be finished")
+    }
+    if len(bamboo.comments["CRAB-CWS145-7"]) != 0 {
+        t.Errorf("expected the next build not to be started")
+    }
+    if stats.counts["scanned"] != 1 {
+        t.Errorf("expected 1 build to be scanned, but %d were", stats.counts["scanned"])
+    }
+}
+
+// Counts how many times the activity stream is read
+type countingBamboo struct {
+    *fakeBamboo
+    mutex sync.Mutex
+    polls int
+}
+
+func (bamboo *countingBamboo) ListRecentResults(maxResults int, before time.Time) ([]RecentResult, error) {
+    bamboo.mutex.Lock()
+    bamboo.polls++
+    bamboo.mutex.Unlock()
+    return bamboo.fakeBamboo.ListRecentResults(maxResults, before)
+}
+
+func (bamboo *countingBamboo) pollCount() int {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    return bamboo.polls
+}
+
+func TestServePollsUntilStopped(t *testing.T) {
+    bamboo := &countingBamboo{fakeBamboo: newFakeBamboo()}
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()},
+    }
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    // serve writes the last good commits to the working directory
+    dir, err := ioutil.TempDir("", "bambot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    workingDir, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.Chdir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Chdir(workingDir)
+
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        serve(bamboo, testRules, nil, nil, time.Millisecond, time.Millisecond, defaultWorkers, nil, stop)
+        close(stopped)
+    }()
+
+    deadline := time.Now().Add(5 * time.Second)
+    for bamboo.pollCount() < 3 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    close(stop)
+    select {
+    case <-stopped:
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected serve to stop")
+    }
+
+    if bamboo.pollCount() < 3 {
+        t.Errorf("expected at least 3 polls, but there were %d", bamboo.pollCount())
+    }
+    // The label keeps the build from being commented on again
+    if len(bamboo.comments["CRAB-CWS144-33"]) != 1 {
+        t.Errorf("expected one comment on CRAB-CWS144-33, but found %d", len(bamboo.comments["CRAB-CWS144-33"]))
+    }
+}
+
+func TestNextDelay(t *testing.T) {
+    if nextDelay(time.Minute, 0) != time.Minute {
+        t.Errorf("expected no jitter")
+    }
+    for i := 0; i < 100; i++ {
+        delay := nextDelay(time.Minute, time.Second)
+        if delay < time.Minute || delay >= time.Minute+time.Second {
+            t.Fatalf("expected a delay between 1m and 1m1s, but got %v", delay)
+        }
+    }
+}
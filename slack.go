@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Only the start of each snippet is posted to Slack; the rest is in the Bamboo comment
+const maxSlackSnippetLines = 10
+
+// Each incoming webhook posts to the channel it was created for, so the notifications for each plan go to a
+// different webhook. From the rules file.
+type SlackRouting struct {
+	// The first route matching a plan is used. Plans without one go to BAMBOT_SLACK_WEBHOOK_URL.
+	Routes []SlackRoute `json:"routes,omitempty"`
+}
+
+// Ex: {"plan": "CRAB-CWS*", "webhook": "CRAB_BUILDS"}, for the webhook in BAMBOT_SLACK_WEBHOOK_URL_CRAB_BUILDS
+type SlackRoute struct {
+	// A plan key, or a pattern like CRAB-CWS* that matches the plan keys of several plans (or plan branches)
+	Plan string `json:"plan"`
+	// The name of the webhook. Its URL is a secret, so it's read from the environment (or a file), not the rules.
+	Webhook string `json:"webhook"`
+}
+
+// Webhook names are part of an environment variable's name, Ex: CRAB_BUILDS
+var slackWebhookNameRegexp = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
+func (route *SlackRoute) compile() error {
+	if route.Plan == "" || route.Webhook == "" {
+		return errors.New("every Slack route needs a plan and a webhook")
+	}
+	if _, err := path.Match(route.Plan, ""); err != nil {
+		return errors.New("Slack route for " + route.Plan + " has an invalid plan: " + err.Error())
+	}
+	if !slackWebhookNameRegexp.MatchString(route.Webhook) {
+		return errors.New("Slack route for " + route.Plan + " has an invalid webhook: " + route.Webhook + " (use upper case letters, digits and _)")
+	}
+	return nil
+}
+
+// The name of the webhook for a plan, Ex: CRAB-CWS144, or "" for the default one
+func (routing SlackRouting) webhook(planKey string) string {
+	for _, route := range routing.Routes {
+		if matched, _ := path.Match(route.Plan, planKey); matched {
+			return route.Webhook
+		}
+	}
+	return ""
+}
+
+// The environment variable with a webhook's URL, Ex: BAMBOT_SLACK_WEBHOOK_URL_CRAB_BUILDS
+func slackWebhookEnv(webhook string) string {
+	if webhook == "" {
+		return "BAMBOT_SLACK_WEBHOOK_URL"
+	}
+	return "BAMBOT_SLACK_WEBHOOK_URL_" + webhook
+}
+
+// Posts the failures Bambot finds to Slack incoming webhooks
+type slackNotifier struct {
+	// By webhook name, with "" for the default webhook
+	webhookUrls map[string]string
+	httpClient  *http.Client
+	routing     SlackRouting
+	// In a dry run, the notifications are only printed
+	dryRun bool
+}
+
+func newSlackNotifier(webhookUrls map[string]string, httpClient *http.Client, routing SlackRouting, dryRun bool) *slackNotifier {
+	return &slackNotifier{webhookUrls: webhookUrls, httpClient: httpClient, routing: routing, dryRun: dryRun}
+}
+
+// What's posted to the webhook
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// Post a build's findings to the webhook for its plan. Plans without a webhook aren't posted. Slack being
+// unavailable doesn't stop the build from being processed, so problems are only written to output.
+func (notifier *slackNotifier) notify(buildKey string, buildNumber string, link string, scanResult ScanResult, output io.Writer) {
+	webhook := notifier.routing.webhook(buildKey)
+	webhookUrl := notifier.webhookUrls[webhook]
+	if webhookUrl == "" {
+		return
+	}
+	description := slackWebhookDescription(webhook)
+	message := slackMessage{Text: slackText(buildKey, buildNumber, link, scanResult)}
+	if notifier.dryRun {
+		fmt.Fprint(output, "\nWould notify the ", description, " in Slack:\n", message.Text, "\n")
+		return
+	}
+	err := notifier.post(webhookUrl, description, message)
+	if err != nil {
+		fmt.Fprint(output, " ... Couldn't notify Slack: ", err)
+		return
+	}
+	fmt.Fprint(output, " ... Notified the ", description, " in Slack")
+}
+
+// The webhook's URL is a secret, so it's described by name instead, Ex: CRAB_BUILDS incoming webhook
+func slackWebhookDescription(webhook string) string {
+	if webhook == "" {
+		return "incoming webhook"
+	}
+	return webhook + " incoming webhook"
+}
+
+func (notifier *slackNotifier) post(webhookUrl string, description string, message slackMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return &RequestError{Service: slackService, Operation: "post to Slack", Url: description, Err: err}
+	}
+	req, err := http.NewRequest("POST", webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return &RequestError{Service: slackService, Operation: "post to Slack", Url: description, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Ex: 404 no_service, or 400 invalid_payload
+	_, err = sendRequest(notifier.httpClient, req, slackService, "post to Slack")
+	if requestErr, ok := err.(*RequestError); ok {
+		requestErr.Url = description
+	}
+	return err
+}
+
+// The notification, in Slack's markup, Ex:
+// Bambot found why <https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33|CRAB-CWS144-33> failed
+// Plan: Crab - feature-branch-144 (CRAB-CWS144), branch: feature-branch-144
+// followed by each finding's rule, comment and the start of its snippet
+func slackText(buildKey string, buildNumber string, link string, scanResult ScanResult) string {
+	text := "Bambot found why <" + link + "|" + buildKey + "-" + buildNumber + "> failed\n"
+	planName := scanResult.Build.Plan.Name
+	if planName == "" {
+		planName = buildKey
+	}
+	text += "Plan: " + escapeSlackText(planName) + " (" + buildKey + ")"
+	if branch := branchName(scanResult.Build.PlanName); branch != "" {
+		text += ", branch: " + escapeSlackText(branch)
+	}
+	text += "\n"
+	for _, finding := range scanResult.Findings {
+		text += "\n*" + finding.RuleName + "*: " + escapeSlackText(finding.Comment) + "\n"
+		if finding.JiraIssueId != "" {
+			text += "JIRA: " + finding.JiraIssueId + "\n"
+		}
+		snippet := truncateLines(finding.LogSnippet, maxSnippetWidth, maxSlackSnippetLines)
+		text += "```\n" + escapeSlackText(snippet) + "\n```\n"
+	}
+	return strings.TrimSuffix(text, "\n")
+}
+
+// The branch a plan builds, Ex: release/R22.0.43 for the plan release-R22.0.43. Plan branches are named after their
+// branch, so the plan's short name is the best guess for the others.
+func branchName(planName string) string {
+	if branch, err := branchNameFromPlanName(planName); err == nil {
+		return branch
+	}
+	return planName
+}
+
+// Slack treats <, > and & as markup
+func escapeSlackText(text string) string {
+	text = strings.Replace(text, "&", "&amp;", -1)
+	text = strings.Replace(text, "<", "&lt;", -1)
+	return strings.Replace(text, ">", "&gt;", -1)
+}
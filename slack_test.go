@@ -0,0 +1,138 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+var testSlackRouting = SlackRouting{
+    Routes: []SlackRoute{
+        {Plan: "CRAB-CWO*", Webhook: "RELEASES"},
+        {Plan: "CRAB-CWS*", Webhook: "CRAB_BUILDS"},
+    },
+}
+
+func TestSlackRouting(t *testing.T) {
+    assertEquals(t, testSlackRouting.webhook("CRAB-CWS144"), "CRAB_BUILDS")
+    assertEquals(t, testSlackRouting.webhook("CRAB-CWO301"), "RELEASES")
+    assertEquals(t, testSlackRouting.webhook("OTHER-PLAN1"), "")
+    assertEquals(t, slackWebhookEnv("CRAB_BUILDS"), "BAMBOT_SLACK_WEBHOOK_URL_CRAB_BUILDS")
+    assertEquals(t, slackWebhookEnv(""), "BAMBOT_SLACK_WEBHOOK_URL")
+
+    rules, err := parseRules([]byte(`{"rules": [], "slack": {"routes": [{"plan": "CRAB-CWS*", "webhook": "CRAB_BUILDS"}]}}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, rules.Slack.webhook("CRAB-CWS144"), "CRAB_BUILDS")
+    for _, content := range []string{
+        `{"rules": [], "slack": {"routes": [{"plan": "CRAB-CWS*"}]}}`,
+        `{"rules": [], "slack": {"routes": [{"plan": "CRAB-[CWS", "webhook": "CRAB_BUILDS"}]}}`,
+        `{"rules": [], "slack": {"routes": [{"plan": "CRAB-CWS*", "webhook": "#crab-builds"}]}}`,
+    } {
+        if _, err := parseRules([]byte(content)); err == nil {
+            t.Errorf("expected an error for %s", content)
+        }
+    }
+}
+
+func TestSlackNotifiesTheWebhookForThePlan(t *testing.T) {
+    defaultWebhook := newFakeSlackWebhook()
+    defer defaultWebhook.Close()
+    crabWebhook := newFakeSlackWebhook()
+    defer crabWebhook.Close()
+    releasesWebhook := newFakeSlackWebhook()
+    defer releasesWebhook.Close()
+
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: time.Now()},
+        {Link: "https://bamboo.example.com/browse/OTHER-PLAN1-JOB1-2", Published: time.Now()},
+    }
+    result := BambooResult{PlanName: "feature-branch-144"}
+    result.Plan.Name = "Crab - feature-branch-144"
+    bamboo.results["CRAB-CWS144-33"] = result
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    bamboo.logs["CRAB-CWS145-JOB1-7"] = "nothing to see here"
+    bamboo.logs["OTHER-PLAN1-JOB1-2"] = readFileToString("test_files/generic.log")
+
+    webhookUrls := map[string]string{
+        "":            defaultWebhook.webhookUrl(),
+        "CRAB_BUILDS": crabWebhook.webhookUrl(),
+        "RELEASES":    releasesWebhook.webhookUrl(),
+    }
+    integrations := &Integrations{slack: newSlackNotifier(webhookUrls, &http.Client{}, testSlackRouting, false)}
+    _, err := handleAllBuilds(bamboo, testRules, nil, integrations, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Builds whose failure wasn't found aren't posted
+    messages := crabWebhook.recordedMessages()
+    if len(messages) != 1 {
+        t.Fatalf("expected 1 message for CRAB_BUILDS but found %d", len(messages))
+    }
+    assertContains(t, messages[0].Text, "Bambot found why <https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33|CRAB-CWS144-33> failed\n" +
+        "Plan: Crab - feature-branch-144 (CRAB-CWS144), branch: feature-branch-144\n\n" +
+        "*generic-error*: Bambot detected an error!\n```\n")
+    assertContains(t, messages[0].Text, "Timed out waiting for Seeq Server to become responsive.")
+    if !strings.HasSuffix(messages[0].Text, "\n```") {
+        t.Errorf("expected the snippet to end the message, but got '%s'", messages[0].Text)
+    }
+
+    // Plans without a route go to the default webhook
+    messages = defaultWebhook.recordedMessages()
+    if len(messages) != 1 {
+        t.Fatalf("expected 1 message for the default webhook but found %d", len(messages))
+    }
+    assertContains(t, messages[0].Text, "|OTHER-PLAN1-2> failed")
+    if len(releasesWebhook.recordedMessages()) != 0 {
+        t.Errorf("expected no messages for RELEASES")
+    }
+
+    // Without a default webhook, they aren't posted at all
+    var output strings.Builder
+    delete(webhookUrls, "")
+    integrations.slack.notify("OTHER-PLAN1", "2", "https://bamboo.example.com/browse/OTHER-PLAN1-JOB1-2", ScanResult{}, &output)
+    assertEquals(t, output.String(), "")
+    if len(defaultWebhook.recordedMessages()) != 1 {
+        t.Errorf("expected no more messages for the default webhook")
+    }
+}
+
+func TestSlackText(t *testing.T) {
+    scanResult := ScanResult{Findings: []Finding{
+        {RuleName: "csharp-compiler-error", Comment: "Bambot detected a C# compiler error (CS0103)!", JiraIssueId: "CRAB-1234",
+            LogSnippet: "List<string> foo && bar\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12"},
+    }}
+    scanResult.Build.PlanName = "release-R22.0.43"
+    assertEquals(t, slackText("CRAB-CWO301", "5", "https://bamboo.example.com/browse/CRAB-CWO301-5", scanResult),
+        "Bambot found why <https://bamboo.example.com/browse/CRAB-CWO301-5|CRAB-CWO301-5> failed\n" +
+        "Plan: CRAB-CWO301 (CRAB-CWO301), branch: release/R22.0.43\n\n" +
+        "*csharp-compiler-error*: Bambot detected a C# compiler error (CS0103)!\n" +
+        "JIRA: CRAB-1234\n" +
+        "```\nList&lt;string&gt; foo &amp;&amp; bar\n2\n3\n4\n5\n6\n7\n8\n9\n10\n...\n```")
+}
+
+// Slack being down doesn't stop Bambot from commenting on the build, and the webhook's URL isn't printed
+func TestSlackUnavailable(t *testing.T) {
+    webhook := newFakeSlackWebhook()
+    defer webhook.Close()
+    webhook.failWith = http.StatusNotFound
+    notifier := webhook.newNotifier()
+    defer forgetSecrets()()
+    addSecret(webhook.webhookUrl())
+
+    scanResult := ScanResult{Findings: []Finding{{RuleName: "generic-error", Comment: "Bambot detected an error!", LogSnippet: "one"}}}
+    var output strings.Builder
+    notifier.notify("CRAB-CWS144", "33", "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", scanResult, &output)
+    assertEquals(t, redact(output.String()), " ... Couldn't notify Slack: failed to post to Slack (incoming webhook): status code 404: no_service\n")
+
+    // Nor in a dry run, which only prints the message
+    notifier.dryRun = true
+    output.Reset()
+    notifier.notify("CRAB-CWS144", "33", "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", scanResult, &output)
+    assertContains(t, output.String(), "Would notify the incoming webhook in Slack:\nBambot found why")
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Where Bambot remembers the builds it has processed, unless BAMBOT_STORE_FILE says otherwise
+const defaultStoreFile = "bambot.db"
+
+var buildsBucket = []byte("builds")
+var fingerprintsBucket = []byte("fingerprints")
+var scansBucket = []byte("scans")
+
+// The newest build that every build up to has been processed, Ex: 2020-01-02T17:51:16Z
+var highWaterMarkKey = []byte("highWaterMark")
+
+// What happened when Bambot processed a build
+const (
+	// Bambot found the cause of the failure, and commented on the build
+	outcomeCommented = "commented"
+	// Bambot scanned the logs, but couldn't find the cause of the failure
+	outcomeNoMatch = "no-match"
+	// The build was already labeled, by an earlier version of Bambot or by a person
+	outcomeLabeled = "labeled"
+	// Bamboo found the test failures, so there was nothing to add
+	outcomeTestsFailed = "tests-failed"
+)
+
+// Everything Bambot knows about a build it has processed
+type BuildRecord struct {
+	// Ex: CRAB-CWS144-33
+	Build       string
+	Link        string
+	ProcessedAt time.Time
+	Outcome     string
+	Findings    []Finding
+	// The comment posted on the build, if any
+	Comment string
+}
+
+// Every build a failure has been found in, by its fingerprint
+type FingerprintRecord struct {
+	// Ex: 3f786850e387550f
+	Fingerprint string
+	// The builds the failure was found in, in the order Bambot processed them, Ex: CRAB-CWS144-33
+	Builds []string
+	// When the earliest of those builds was published, and its link
+	FirstSeen time.Time
+	FirstLink string
+	// The JIRA issue Bambot filed for the failure, if any
+	FiledIssue string
+}
+
+// A local database of the builds Bambot has processed, so they aren't processed again. The database file is only open
+// (and locked) while it's being read or written, so `bambot history` can read it while `bambot serve` is running.
+type Store struct {
+	fileName string
+	readOnly bool
+
+	mutex sync.Mutex
+	db    *bolt.DB
+	// How many reads and writes are using db, which is closed when the last one is done
+	users  int
+	closed bool
+}
+
+// How long to wait for another process (Ex: `bambot serve`) to finish with the database
+const storeTimeout = 10 * time.Second
+
+// Open the store, creating it if it doesn't exist yet
+func openStore(fileName string) (*Store, error) {
+	store := &Store{fileName: fileName}
+	err := store.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(buildsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(fingerprintsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(scansBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Open an existing store without changing it. Recording builds (or anything else) in a read-only store does nothing.
+func openStoreReadOnly(fileName string) (*Store, error) {
+	store := &Store{fileName: fileName, readOnly: true}
+	err := store.view(func(tx *bolt.Tx) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Stop using the store. Reads and writes that have already started are finished first.
+func (store *Store) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.closed = true
+	return nil
+}
+
+// Open the database, unless another read or write already has, and return a function to call when done with it
+func (store *Store) open() (*bolt.DB, func(), error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		return nil, nil, bolt.ErrDatabaseNotOpen
+	}
+	if store.db == nil {
+		db, err := bolt.Open(store.fileName, 0644, &bolt.Options{Timeout: storeTimeout, ReadOnly: store.readOnly})
+		if err != nil {
+			return nil, nil, err
+		}
+		store.db = db
+	}
+	store.users++
+	db := store.db
+	return db, func() {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		store.users--
+		if store.users == 0 {
+			_ = store.db.Close()
+			store.db = nil
+		}
+	}, nil
+}
+
+func (store *Store) view(fn func(tx *bolt.Tx) error) error {
+	db, done, err := store.open()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return db.View(fn)
+}
+
+func (store *Store) update(fn func(tx *bolt.Tx) error) error {
+	db, done, err := store.open()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return db.Update(fn)
+}
+
+// Look up a build, Ex: CRAB-CWS144-33. Returns false if the build hasn't been processed.
+func (store *Store) GetBuild(build string) (BuildRecord, bool, error) {
+	var record BuildRecord
+	found := false
+	err := store.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(buildsBucket)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get([]byte(build))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &record)
+	})
+	return record, found, err
+}
+
+// Remember that a build was processed, replacing anything recorded about it before
+func (store *Store) RecordBuild(record BuildRecord) error {
+	if store.readOnly {
+		return nil
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(buildsBucket).Put([]byte(record.Build), value)
+	})
+}
+
+// When the newest build was published that every build up to has been processed, or the zero time if none have
+func (store *Store) GetHighWaterMark() (time.Time, error) {
+	var mark time.Time
+	err := store.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scansBucket)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(highWaterMarkKey)
+		if value == nil {
+			return nil
+		}
+		return mark.UnmarshalText(value)
+	})
+	return mark, err
+}
+
+// Remember how far back the builds have all been processed. The mark never moves back.
+func (store *Store) RecordHighWaterMark(mark time.Time) error {
+	if store.readOnly {
+		return nil
+	}
+	value, err := mark.MarshalText()
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scansBucket)
+		var previous time.Time
+		if current := bucket.Get(highWaterMarkKey); current != nil && previous.UnmarshalText(current) == nil && !mark.After(previous) {
+			return nil
+		}
+		return bucket.Put(highWaterMarkKey, value)
+	})
+}
+
+// Look up a failure by its fingerprint. Returns false if it hasn't been found in any build.
+func (store *Store) GetFingerprint(fingerprint string) (FingerprintRecord, bool, error) {
+	var record FingerprintRecord
+	found := false
+	err := store.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fingerprintsBucket)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get([]byte(fingerprint))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &record)
+	})
+	return record, found, err
+}
+
+// Remember that a failure was found in a build (Ex: CRAB-CWS144-33), and return everything known about it. Finding it
+// in the same build again (Ex: in two jobs, or when the build is processed again after an error) doesn't count twice.
+// A read-only store returns what the record would be, without changing it.
+func (store *Store) RecordOccurrence(fingerprint string, build string, link string, published time.Time) (FingerprintRecord, error) {
+	return store.updateFingerprint(fingerprint, func(record *FingerprintRecord) {
+		record.addOccurrence(build, link, published)
+	})
+}
+
+// Builds are processed newest first, so the first build processed isn't necessarily the first one published
+func (record *FingerprintRecord) addOccurrence(build string, link string, published time.Time) {
+	for _, recorded := range record.Builds {
+		if recorded == build {
+			return
+		}
+	}
+	record.Builds = append(record.Builds, build)
+	if record.FirstSeen.IsZero() || published.Before(record.FirstSeen) {
+		record.FirstSeen = published
+		record.FirstLink = link
+	}
+}
+
+// How many different plans (Ex: CRAB-CWS144) the failure was found in
+func (record FingerprintRecord) plans() int {
+	plans := make(map[string]bool)
+	for _, build := range record.Builds {
+		plans[build[:strings.LastIndex(build, "-")]] = true
+	}
+	return len(plans)
+}
+
+// Remember the JIRA issue Bambot filed for a failure, so it isn't filed again
+func (store *Store) RecordFiledIssue(fingerprint string, issue string) error {
+	_, err := store.updateFingerprint(fingerprint, func(record *FingerprintRecord) {
+		record.FiledIssue = issue
+	})
+	return err
+}
+
+func (store *Store) updateFingerprint(fingerprint string, update func(record *FingerprintRecord)) (FingerprintRecord, error) {
+	if store.readOnly {
+		record, _, err := store.GetFingerprint(fingerprint)
+		if err != nil {
+			return record, err
+		}
+		record.Fingerprint = fingerprint
+		update(&record)
+		return record, nil
+	}
+	// Read and write in one transaction, since several builds can find the same failure at the same time
+	record := FingerprintRecord{Fingerprint: fingerprint}
+	err := store.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fingerprintsBucket)
+		if value := bucket.Get([]byte(fingerprint)); value != nil {
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+		}
+		update(&record)
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fingerprint), value)
+	})
+	return record, err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestStoreRemembersBuilds(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, found, err := store.GetBuild("CRAB-CWS144-33")
+    if err != nil || found {
+        t.Fatalf("expected an empty store, but found=%v err=%v", found, err)
+    }
+
+    processedAt := time.Date(2020, 1, 7, 7, 31, 47, 0, time.UTC)
+    err = store.RecordBuild(BuildRecord{
+        Build:       "CRAB-CWS144-33",
+        Link:        "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33",
+        ProcessedAt: processedAt,
+        Outcome:     outcomeCommented,
+        Findings:    []Finding{{RuleName: "generic-error", Comment: "Bambot detected an error!", Job: "CRAB-CWS144-JOB1-33"}},
+        Comment:     "Bambot detected an error!",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = store.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The build is still there after reopening the store, even read-only
+    store, err = openStoreReadOnly(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    record, found, err := store.GetBuild("CRAB-CWS144-33")
+    if err != nil || !found {
+        t.Fatalf("expected to find CRAB-CWS144-33, but found=%v err=%v", found, err)
+    }
+    assertEquals(t, record.Outcome, outcomeCommented)
+    assertEquals(t, record.Comment, "Bambot detected an error!")
+    assertEquals(t, record.Findings[0].RuleName, "generic-error")
+    assertEquals(t, record.Findings[0].Job, "CRAB-CWS144-JOB1-33")
+    if !record.ProcessedAt.Equal(processedAt) {
+        t.Errorf("expected the build to be processed at %v but got %v", processedAt, record.ProcessedAt)
+    }
+
+    // Recording in a read-only store does nothing
+    err = store.RecordBuild(BuildRecord{Build: "CRAB-CWS145-7", Outcome: outcomeNoMatch})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, found, _ := store.GetBuild("CRAB-CWS145-7"); found {
+        t.Errorf("expected the read-only store not to change")
+    }
+}
+
+// Builds in the store aren't processed again, so their labels aren't even read
+func TestHandleAllBuildsSkipsRecordedBuilds(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    bamboo := newFakeBamboo()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: time.Now()},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS146-JOB1-12", Published: time.Now(), Content: "2 tests failed"},
+    }
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    bamboo.logs["CRAB-CWS145-JOB1-7"] = "nothing to see here"
+
+    stats, err := handleAllBuilds(bamboo, testRules, store, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Fatalf("expected no failures, but found %v", stats.failures)
+    }
+
+    record, found, err := store.GetBuild("CRAB-CWS144-33")
+    if err != nil || !found {
+        t.Fatalf("expected to find CRAB-CWS144-33, but found=%v err=%v", found, err)
+    }
+    assertEquals(t, record.Outcome, outcomeCommented)
+    assertEquals(t, record.Comment, bamboo.comments["CRAB-CWS144-33"][0])
+    assertEquals(t, record.Findings[0].RuleName, "generic-error")
+    record, _, _ = store.GetBuild("CRAB-CWS145-7")
+    assertEquals(t, record.Outcome, outcomeNoMatch)
+    record, _, _ = store.GetBuild("CRAB-CWS146-12")
+    assertEquals(t, record.Outcome, outcomeTestsFailed)
+
+    // The second time around, Bamboo isn't asked about any of them. The builds before the newest one aren't even
+    // listed, since they're older than the high-water mark.
+    bamboo.errors["GetLabels"] = &RequestError{Service: bambooService, Operation: "get labels", Url: "labels", StatusCode: 503}
+    bamboo.errors["GetResult"] = &RequestError{Service: bambooService, Operation: "get result", Url: "result", StatusCode: 503}
+    stats, err = handleAllBuilds(bamboo, testRules, store, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.failures) != 0 {
+        t.Errorf("expected no failures, but found %v", stats.failures)
+    }
+    if stats.counts["scanned"] != 1 || stats.counts["skipped"] != 1 {
+        t.Errorf("expected only the newest build to be listed and skipped, but found %v", stats.counts)
+    }
+    if len(bamboo.comments["CRAB-CWS144-33"]) != 1 {
+        t.Errorf("expected only one comment on CRAB-CWS144-33, but found %d", len(bamboo.comments["CRAB-CWS144-33"]))
+    }
+}
+
+func TestStoreCountsOccurrences(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    published := time.Date(2020, 1, 7, 7, 31, 47, 0, time.UTC)
+    _, err = store.RecordOccurrence("3f786850e387550f", "CRAB-CWS144-33", "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", published)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The same build only counts once
+    _, err = store.RecordOccurrence("3f786850e387550f", "CRAB-CWS144-33", "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", published)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Builds published earlier can be processed later
+    record, err := store.RecordOccurrence("3f786850e387550f", "CRAB-CWS145-7", "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", published.Add(-time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, fmt.Sprint(record.Builds), "[CRAB-CWS144-33 CRAB-CWS145-7]")
+    assertEquals(t, record.FirstLink, "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7")
+    if !record.FirstSeen.Equal(published.Add(-time.Hour)) {
+        t.Errorf("expected the failure to be first seen at %v but got %v", published.Add(-time.Hour), record.FirstSeen)
+    }
+    err = store.RecordFiledIssue("3f786850e387550f", "CRAB-100")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = store.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A read-only store says what the record would be, without changing it
+    store, err = openStoreReadOnly(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    record, err = store.RecordOccurrence("3f786850e387550f", "CRAB-CWS144-34", "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-34", published)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, fmt.Sprint(record.Builds), "[CRAB-CWS144-33 CRAB-CWS145-7 CRAB-CWS144-34]")
+    assertEquals(t, fmt.Sprint(record.plans()), "2")
+    assertEquals(t, record.FiledIssue, "CRAB-100")
+    record, _, _ = store.GetFingerprint("3f786850e387550f")
+    assertEquals(t, fmt.Sprint(record.Builds), "[CRAB-CWS144-33 CRAB-CWS145-7]")
+}
+
+// The same failure on several branches is counted across scans
+func TestCommentsCountOccurrences(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    bamboo := newFakeBamboo()
+    now := time.Now()
+    bamboo.recentResults = []RecentResult{
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: now.Add(-time.Hour)},
+        {Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: now.Add(-2 * time.Hour)},
+    }
+    for _, job := range []string{"CRAB-CWS144-JOB1-33", "CRAB-CWS145-JOB1-7", "CRAB-CWS146-JOB1-12"} {
+        bamboo.logs[job] = readFileToString("test_files/generic.log")
+    }
+    _, err = handleAllBuilds(bamboo, testRules, store, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    bamboo.recentResults = append([]RecentResult{{Link: "https://bamboo.example.com/browse/CRAB-CWS146-JOB1-12", Published: now}}, bamboo.recentResults...)
+    _, err = handleAllBuilds(bamboo, testRules, store, nil, defaultWorkers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertContains(t, bamboo.comments["CRAB-CWS146-12"][0], "Seen 3 times across 3 plans since " +
+        now.Add(-2*time.Hour).Format(occurrenceDateFormat) + ", first in https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7\n\n")
+}
+
+func tempStoreFile(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "bambot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return filepath.Join(dir, "bambot.db")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many requests are sent to the same host at the same time, unless BAMBOT_MAX_REQUESTS_PER_HOST says otherwise
+const defaultMaxRequestsPerHost = 4
+
+// Limits how many requests are in progress to each host, so several workers don't overwhelm Bamboo.
+// A request is in progress until its response body is closed, since downloading a log can take a while.
+type hostLimitTransport struct {
+	base  http.RoundTripper
+	limit int
+
+	mutex sync.Mutex
+	// A semaphore for each host
+	hosts map[string]chan struct{}
+}
+
+func newHostLimitTransport(base http.RoundTripper, limit int) *hostLimitTransport {
+	if limit < 1 {
+		limit = 1
+	}
+	return &hostLimitTransport{base: base, limit: limit, hosts: make(map[string]chan struct{})}
+}
+
+func (transport *hostLimitTransport) semaphore(host string) chan struct{} {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	semaphore, ok := transport.hosts[host]
+	if !ok {
+		semaphore = make(chan struct{}, transport.limit)
+		transport.hosts[host] = semaphore
+	}
+	return semaphore
+}
+
+func (transport *hostLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	semaphore := transport.semaphore(req.URL.Host)
+	select {
+	case semaphore <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil {
+		<-semaphore
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-semaphore }}
+	return resp, nil
+}
+
+// A response body that gives back its place in the semaphore when it's closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (body *releasingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
+
+// How long Bamboo can go without sending anything before a request is abandoned, unless BAMBOT_TIMEOUT says otherwise
+const defaultTimeout = time.Minute
+
+// How many times an idempotent request is retried, unless BAMBOT_RETRIES says otherwise
+const defaultRetries = 3
+
+// The most requests sent to Bamboo each second, unless BAMBOT_REQUESTS_PER_SECOND says otherwise
+const defaultRequestsPerSecond = 10.0
+
+// The first retry waits this long, and each retry after that waits twice as long as the one before
+const retryBaseDelay = time.Second
+
+// No retry waits longer than this, even if Bamboo asks for longer with Retry-After
+const retryMaxDelay = 2 * time.Minute
+
+// How Bambot talks to Bamboo over HTTP
+type httpOptions struct {
+	maxRequestsPerHost int
+	timeout            time.Duration
+	retries            int
+	requestsPerSecond  float64
+}
+
+// Add the flags for the HTTP options, which default to the environment variables
+func addHttpFlags(flags *flag.FlagSet) *httpOptions {
+	options := &httpOptions{}
+	flags.IntVar(&options.maxRequestsPerHost, "max-requests-per-host", intFromEnv("BAMBOT_MAX_REQUESTS_PER_HOST", defaultMaxRequestsPerHost), "how many requests to send to Bamboo at the same time")
+	flags.DurationVar(&options.timeout, "timeout", durationFromEnv("BAMBOT_TIMEOUT", defaultTimeout), "how long Bamboo can go without sending anything before a request is abandoned")
+	flags.IntVar(&options.retries, "retries", intFromEnv("BAMBOT_RETRIES", defaultRetries), "how many times to retry requests that only read from Bamboo")
+	flags.Float64Var(&options.requestsPerSecond, "requests-per-second", floatFromEnv("BAMBOT_REQUESTS_PER_SECOND", defaultRequestsPerSecond), "the most requests to send to Bamboo each second, or 0 for no limit")
+	return options
+}
+
+// Each request goes through the retries, then the rate limit, then the limit for its host, then the timeout
+func (options *httpOptions) transport(base http.RoundTripper) http.RoundTripper {
+	var transport http.RoundTripper = newTimeoutTransport(base, options.timeout)
+	transport = newHostLimitTransport(transport, options.maxRequestsPerHost)
+	transport = newRateLimitTransport(transport, options.requestsPerSecond)
+	return newRetryTransport(transport, options.retries)
+}
+
+// Abandons a request when Bamboo goes too long without sending anything: either the response headers, or the next
+// part of the body. A long log download is fine, as long as it keeps making progress.
+type timeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func newTimeoutTransport(base http.RoundTripper, timeout time.Duration) *timeoutTransport {
+	return &timeoutTransport{base: base, timeout: timeout}
+}
+
+func (transport *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport.timeout <= 0 {
+		return transport.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(transport.timeout, cancel)
+	resp, err := transport.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	timer.Reset(transport.timeout)
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, timer: timer, timeout: transport.timeout, cancel: cancel}
+	return resp, nil
+}
+
+// A response body that restarts the timeout whenever something is read
+type timeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (body *timeoutBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if n > 0 {
+		body.timer.Reset(body.timeout)
+	}
+	return n, err
+}
+
+func (body *timeoutBody) Close() error {
+	body.timer.Stop()
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// Spaces out requests so that no more than requestsPerSecond are sent, across all hosts and workers
+type rateLimitTransport struct {
+	base     http.RoundTripper
+	interval time.Duration
+
+	mutex sync.Mutex
+	// When the next request can be sent
+	next time.Time
+}
+
+func newRateLimitTransport(base http.RoundTripper, requestsPerSecond float64) *rateLimitTransport {
+	transport := &rateLimitTransport{base: base}
+	if requestsPerSecond > 0 {
+		transport.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return transport
+}
+
+func (transport *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport.interval > 0 {
+		err := sleepContext(req.Context(), transport.reserve())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return transport.base.RoundTrip(req)
+}
+
+// Reserve the next free slot, and return how long to wait for it
+func (transport *rateLimitTransport) reserve() time.Duration {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	now := time.Now()
+	if transport.next.Before(now) {
+		transport.next = now
+	}
+	wait := transport.next.Sub(now)
+	transport.next = transport.next.Add(transport.interval)
+	return wait
+}
+
+// Retries requests that only read from Bamboo (GET and HEAD), when there's no response or Bamboo is too busy.
+// Requests that change something, like adding a comment, are never retried, since they might have worked.
+// Several builds are handled at once, so retries aren't printed; if every attempt fails, the last error is returned.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	// Replaced in tests, to keep them fast
+	sleep func(ctx context.Context, duration time.Duration) error
+}
+
+func newRetryTransport(base http.RoundTripper, retries int) *retryTransport {
+	return &retryTransport{base: base, retries: retries, sleep: sleepContext}
+}
+
+func (transport *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return transport.base.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := transport.base.RoundTrip(req)
+		if attempt == transport.retries || !shouldRetry(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := retryDelay(attempt, resp)
+		if resp != nil {
+			// Read the rest of the response, so the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			_ = resp.Body.Close()
+		}
+		err = transport.sleep(req.Context(), delay)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Wait twice as long after each attempt, unless Bamboo says how long to wait
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			delay = retryAfter
+		}
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// Retry-After is either a number of seconds, or a date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
+// Sleep, unless the context is done first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send a request to one of the services, and read the whole response body.
+// It's an error if the service doesn't respond with a 2xx status code.
+func sendRequest(httpClient *http.Client, req *http.Request, service string, operation string) ([]byte, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, &RequestError{Service: service, Operation: operation, Url: req.URL.String(), Err: err}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	closeErr := resp.Body.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, &RequestError{Service: service, Operation: operation, Url: req.URL.String(), StatusCode: resp.StatusCode, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &RequestError{Service: service, Operation: operation, Url: req.URL.String(), StatusCode: resp.StatusCode, Message: truncateLine(string(body), 200)}
+	}
+	return body, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestHostLimitTransport(t *testing.T) {
+    var mutex sync.Mutex
+    inProgress := 0
+    maxInProgress := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mutex.Lock()
+        inProgress++
+        if inProgress > maxInProgress {
+            maxInProgress = inProgress
+        }
+        mutex.Unlock()
+
+        time.Sleep(10 * time.Millisecond)
+        mutex.Lock()
+        inProgress--
+        mutex.Unlock()
+        _, _ = w.Write([]byte("ok"))
+    }))
+    defer server.Close()
+
+    client := &http.Client{Transport: newHostLimitTransport(http.DefaultTransport, 2)}
+    var waitGroup sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            resp, err := client.Get(server.URL)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            _, _ = ioutil.ReadAll(resp.Body)
+            _ = resp.Body.Close()
+        }()
+    }
+    waitGroup.Wait()
+
+    if maxInProgress < 1 || maxInProgress > 2 {
+        t.Errorf("expected at most 2 requests at a time, but there were %d", maxInProgress)
+    }
+}
+
+// A request is in progress until its body is closed
+func TestHostLimitTransportWaitsForTheBodyToBeClosed(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, _ = w.Write([]byte("ok"))
+    }))
+    defer server.Close()
+
+    client := &http.Client{Transport: newHostLimitTransport(http.DefaultTransport, 1)}
+    first, err := client.Get(server.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        second, err := client.Get(server.URL)
+        if err == nil {
+            _ = second.Body.Close()
+        }
+        close(done)
+    }()
+    select {
+    case <-done:
+        t.Fatal("expected the second request to wait for the first")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    _ = first.Body.Close()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected the second request to be sent once the first was closed")
+    }
+}
+
+// A retry transport that doesn't really sleep, but remembers how long it would have
+func newTestRetryTransport(retries int, delays *[]time.Duration) *retryTransport {
+    transport := newRetryTransport(http.DefaultTransport, retries)
+    transport.sleep = func(ctx context.Context, duration time.Duration) error {
+        *delays = append(*delays, duration)
+        return nil
+    }
+    return transport
+}
+
+func TestRetryTransportBacksOff(t *testing.T) {
+    attempts := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts++
+        if attempts < 4 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        _, _ = w.Write([]byte("ok"))
+    }))
+    defer server.Close()
+
+    var delays []time.Duration
+    client := &http.Client{Transport: newTestRetryTransport(3, &delays)}
+    resp, err := client.Get(server.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(resp.Body)
+    _ = resp.Body.Close()
+    assertEquals(t, string(body), "ok")
+    assertEquals(t, fmt.Sprint(attempts), "4")
+    assertEquals(t, fmt.Sprint(delays), "[1s 2s 4s]")
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+    attempts := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts++
+        w.Header().Set("Retry-After", "7")
+        w.WriteHeader(http.StatusTooManyRequests)
+    }))
+    defer server.Close()
+
+    var delays []time.Duration
+    client := &http.Client{Transport: newTestRetryTransport(2, &delays)}
+    resp, err := client.Get(server.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = resp.Body.Close()
+    // The last response is returned as is
+    assertEquals(t, resp.Status, "429 Too Many Requests")
+    assertEquals(t, fmt.Sprint(attempts), "3")
+    // Retry-After wins over the backoff
+    assertEquals(t, fmt.Sprint(delays), "[7s 7s]")
+}
+
+// Comments and labels might have been added even if Bamboo answered with an error, so they aren't retried
+func TestRetryTransportOnlyRetriesReads(t *testing.T) {
+    attempts := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts++
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer server.Close()
+
+    var delays []time.Duration
+    client := &http.Client{Transport: newTestRetryTransport(3, &delays)}
+    resp, err := client.Post(server.URL, "application/x-www-form-urlencoded", strings.NewReader("content=hi"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = resp.Body.Close()
+    assertEquals(t, fmt.Sprint(attempts), "1")
+
+    // Other errors mean retrying won't help
+    notFoundAttempts := 0
+    notFoundServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        notFoundAttempts++
+        w.WriteHeader(http.StatusNotFound)
+    }))
+    defer notFoundServer.Close()
+    resp, err = client.Get(notFoundServer.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = resp.Body.Close()
+    assertEquals(t, fmt.Sprint(notFoundAttempts), "1")
+    assertEquals(t, fmt.Sprint(delays), "[]")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+    now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+    for _, test := range []struct {
+        value    string
+        expected time.Duration
+        ok       bool
+    }{
+        {"", 0, false},
+        {"120", 2 * time.Minute, true},
+        {"-1", 0, false},
+        {"Sun, 01 Mar 2020 12:00:30 GMT", 30 * time.Second, true},
+        {"Sun, 01 Mar 2020 11:00:00 GMT", 0, true},
+        {"soon", 0, false},
+    } {
+        delay, ok := parseRetryAfter(test.value, now)
+        if delay != test.expected || ok != test.ok {
+            t.Errorf("%q: expected %v, %v but got %v, %v", test.value, test.expected, test.ok, delay, ok)
+        }
+    }
+}
+
+func TestTimeoutTransport(t *testing.T) {
+    release := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/slow" {
+            // Send the log a bit at a time, which is fine as long as each part arrives in time
+            for i := 0; i < 5; i++ {
+                _, _ = w.Write([]byte("line\n"))
+                w.(http.Flusher).Flush()
+                time.Sleep(20 * time.Millisecond)
+            }
+            return
+        }
+        <-release
+    }))
+    defer server.Close()
+    defer close(release)
+
+    client := &http.Client{Transport: newTimeoutTransport(http.DefaultTransport, 100*time.Millisecond)}
+    resp, err := client.Get(server.URL + "/hung")
+    if err == nil {
+        _ = resp.Body.Close()
+        t.Fatal("expected the hung request to time out")
+    }
+
+    resp, err = client.Get(server.URL + "/slow")
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, err := ioutil.ReadAll(resp.Body)
+    _ = resp.Body.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    assertEquals(t, string(body), strings.Repeat("line\n", 5))
+}
+
+func TestRateLimitTransport(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, _ = w.Write([]byte("ok"))
+    }))
+    defer server.Close()
+
+    client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 50)}
+    start := time.Now()
+    for i := 0; i < 6; i++ {
+        resp, err := client.Get(server.URL)
+        if err != nil {
+            t.Fatal(err)
+        }
+        _ = resp.Body.Close()
+    }
+    // The first request goes right away, and each one after that waits 20ms
+    if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+        t.Errorf("expected 6 requests to take at least 100ms, but they took %v", elapsed)
+    }
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How many builds can wait to be scanned before the webhook starts turning them away
+const webhookQueueSize = 100
+
+// Webhook payloads are small, so anything bigger than this is rejected
+const maxWebhookPayloadSize = 1024 * 1024
+
+// A build Bamboo told us about, waiting to be scanned
+type webhookBuild struct {
+	recentResult RecentResult
+	// Ex: CRAB-CWS144 and 33
+	buildKey    string
+	buildNumber string
+}
+
+// The parts of a Bamboo webhook (or notification) payload Bambot uses, Ex:
+// {"build": {"buildResultKey": "CRAB-CWS144-33", "status": "FAILED"}}
+type webhookPayload struct {
+	Build struct {
+		// A build result key (Ex: CRAB-CWS144-33) or a job result key (Ex: CRAB-CWS144-JOB1-33)
+		BuildResultKey string `json:"buildResultKey"`
+		Status         string `json:"status"`
+	} `json:"build"`
+}
+
+// Receives Bamboo's build completed events, and queues the failed builds to be scanned
+type webhookHandler struct {
+	bambooUrl string
+	secret    string
+	queue     chan<- webhookBuild
+}
+
+func newWebhookHandler(bambooUrl string, secret string, queue chan<- webhookBuild) *webhookHandler {
+	return &webhookHandler{bambooUrl: bambooUrl, secret: secret, queue: queue}
+}
+
+func (handler *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayloadSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !handler.authorized(r, body) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var payload webhookPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	build, err := parseBuildArg(payload.Build.BuildResultKey)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only failed builds need to be scanned
+	if !strings.EqualFold(payload.Build.Status, "failed") {
+		_, _ = fmt.Fprintln(w, "Ignoring "+build+": status is '"+payload.Build.Status+"'")
+		return
+	}
+
+	separator := strings.LastIndex(build, "-")
+	queued := webhookBuild{
+		recentResult: RecentResult{Link: handler.bambooUrl + "/browse/" + build, Published: time.Now()},
+		buildKey:     build[:separator],
+		buildNumber:  build[separator+1:],
+	}
+	select {
+	case handler.queue <- queued:
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintln(w, "Queued "+build)
+	default:
+		// Bamboo will try again later
+		http.Error(w, "Too many builds waiting to be scanned", http.StatusServiceUnavailable)
+	}
+}
+
+// The secret can be used to sign the payload (the X-Hub-Signature header, as sent by Bamboo's webhooks),
+// or sent as is, in the X-Bambot-Secret header or the secret query parameter
+func (handler *webhookHandler) authorized(r *http.Request, body []byte) bool {
+	if signature := r.Header.Get("X-Hub-Signature"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(handler.secret))
+		_, _ = mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+
+	token := r.Header.Get("X-Bambot-Secret")
+	if token == "" {
+		token = r.URL.Query().Get("secret")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(handler.secret)) == 1
+}
+
+// Scan a build from the webhook right away
+func handleWebhookBuild(build webhookBuild, bamboo Bamboo, rules *RulesFile, store *Store, integrations *Integrations) {
+	var output strings.Builder
+	output.WriteString("\n" + build.recentResult.Link + " (from webhook) : ")
+	stats := newScanStats()
+	// The webhook doesn't say whether Bamboo found failing tests, so ask for the result. Then the build is skipped
+	// the same way as one from the activity stream, and the result isn't fetched again to scan it.
+	recentResult := build.recentResult
+	result, err := bamboo.GetResult(build.buildKey, build.buildNumber)
+	if err == nil {
+		recentResult.Content = testsFailedContent(result.FailedTestCount)
+		recentResult.Result = &result
+		err = handleBuildResult(recentResult, build.buildKey, build.buildNumber, bamboo, rules, store, integrations, stats, &output)
+	}
+	if err != nil {
+		fmt.Fprint(&output, "Failed: ", err)
+	}
+	fmt.Println(redact(output.String()))
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const testWebhookSecret = "s3cret"
+
+func postWebhook(handler http.Handler, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("POST", target, strings.NewReader(body))
+    for name, value := range headers {
+        req.Header.Set(name, value)
+    }
+    recorder := httptest.NewRecorder()
+    handler.ServeHTTP(recorder, req)
+    return recorder
+}
+
+func TestWebhookQueuesFailedBuilds(t *testing.T) {
+    queue := make(chan webhookBuild, 1)
+    handler := newWebhookHandler("https://bamboo.example.com", testWebhookSecret, queue)
+
+    body := `{"build": {"buildResultKey": "CRAB-CWS144-33", "status": "FAILED"}}`
+    recorder := postWebhook(handler, "/webhook", body, map[string]string{"X-Bambot-Secret": testWebhookSecret})
+    if recorder.Code != http.StatusAccepted {
+        t.Fatalf("expected status code 202 but got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    build := <-queue
+    assertEquals(t, build.buildKey, "CRAB-CWS144")
+    assertEquals(t, build.buildNumber, "33")
+    assertEquals(t, build.recentResult.Link, "https://bamboo.example.com/browse/CRAB-CWS144-33")
+
+    // Job result keys work too
+    body = `{"build": {"buildResultKey": "CRAB-CWS145-JOB1-7", "status": "Failed"}}`
+    recorder = postWebhook(handler, "/webhook?secret="+testWebhookSecret, body, nil)
+    if recorder.Code != http.StatusAccepted {
+        t.Fatalf("expected status code 202 but got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    build = <-queue
+    assertEquals(t, build.buildKey, "CRAB-CWS145")
+    assertEquals(t, build.buildNumber, "7")
+
+    // Successful builds are ignored
+    body = `{"build": {"buildResultKey": "CRAB-CWS146-12", "status": "SUCCESS"}}`
+    recorder = postWebhook(handler, "/webhook", body, map[string]string{"X-Bambot-Secret": testWebhookSecret})
+    if recorder.Code != http.StatusOK || len(queue) != 0 {
+        t.Errorf("expected the successful build to be ignored, but got status code %d", recorder.Code)
+    }
+
+    // When the queue is full, Bamboo has to try again later
+    body = `{"build": {"buildResultKey": "CRAB-CWS147-2", "status": "FAILED"}}`
+    postWebhook(handler, "/webhook", body, map[string]string{"X-Bambot-Secret": testWebhookSecret})
+    recorder = postWebhook(handler, "/webhook", body, map[string]string{"X-Bambot-Secret": testWebhookSecret})
+    if recorder.Code != http.StatusServiceUnavailable {
+        t.Errorf("expected status code 503 but got %d", recorder.Code)
+    }
+}
+
+func TestWebhookSignature(t *testing.T) {
+    queue := make(chan webhookBuild, 1)
+    handler := newWebhookHandler("https://bamboo.example.com", testWebhookSecret, queue)
+    body := `{"build": {"buildResultKey": "CRAB-CWS144-33", "status": "FAILED"}}`
+
+    mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+    mac.Write([]byte(body))
+    signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    recorder := postWebhook(handler, "/webhook", body, map[string]string{"X-Hub-Signature": signature})
+    if recorder.Code != http.StatusAccepted {
+        t.Errorf("expected status code 202 but got %d: %s", recorder.Code, recorder.Body.String())
+    }
+
+    // A signature for a different payload doesn't count, even with the right secret
+    recorder = postWebhook(handler, "/webhook?secret="+testWebhookSecret, strings.Replace(body, "33", "34", 1),
+        map[string]string{"X-Hub-Signature": signature})
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("expected status code 401 but got %d", recorder.Code)
+    }
+}
+
+func TestWebhookRejectsBadRequests(t *testing.T) {
+    queue := make(chan webhookBuild, 10)
+    handler := newWebhookHandler("https://bamboo.example.com", testWebhookSecret, queue)
+    body := `{"build": {"buildResultKey": "CRAB-CWS144-33", "status": "FAILED"}}`
+
+    for _, test := range []struct {
+        name     string
+        target   string
+        body     string
+        headers  map[string]string
+        expected int
+    }{
+        {"no secret", "/webhook", body, nil, http.StatusUnauthorized},
+        {"wrong secret", "/webhook", body, map[string]string{"X-Bambot-Secret": "wrong"}, http.StatusUnauthorized},
+        {"not JSON", "/webhook?secret=" + testWebhookSecret, "build failed", nil, http.StatusBadRequest},
+        {"no build", "/webhook?secret=" + testWebhookSecret, `{"build": {"status": "FAILED"}}`, nil, http.StatusBadRequest},
+    } {
+        recorder := postWebhook(handler, test.target, test.body, test.headers)
+        if recorder.Code != test.expected {
+            t.Errorf("%s: expected status code %d but got %d", test.name, test.expected, recorder.Code)
+        }
+    }
+
+    req := httptest.NewRequest("GET", "/webhook?secret="+testWebhookSecret, nil)
+    recorder := httptest.NewRecorder()
+    handler.ServeHTTP(recorder, req)
+    if recorder.Code != http.StatusMethodNotAllowed {
+        t.Errorf("expected status code 405 but got %d", recorder.Code)
+    }
+    if len(queue) != 0 {
+        t.Errorf("expected nothing to be queued, but %d builds were", len(queue))
+    }
+}
+
+// Builds from the webhook are scanned right away, without waiting for the next poll
+func TestServeScansQueuedBuilds(t *testing.T) {
+    bamboo := newFakeBamboo()
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    dir, err := ioutil.TempDir("", "bambot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    workingDir, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.Chdir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Chdir(workingDir)
+
+    queue := make(chan webhookBuild)
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        serve(bamboo, testRules, nil, nil, time.Hour, 0, defaultWorkers, queue, stop)
+        close(stopped)
+    }()
+
+    queue <- webhookBuild{
+        recentResult: RecentResult{Link: "https://bamboo.example.com/browse/CRAB-CWS144-33", Published: time.Now()},
+        buildKey:     "CRAB-CWS144",
+        buildNumber:  "33",
+    }
+    // The build is finished before serve looks at stop again
+    close(stop)
+    select {
+    case <-stopped:
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected serve to stop")
+    }
+
+    comments := bamboo.comments["CRAB-CWS144-33"]
+    if len(comments) != 1 {
+        t.Fatalf("expected one comment on CRAB-CWS144-33, but found %d", len(comments))
+    }
+    assertContains(t, comments[0], "Bambot detected an error!")
+}
+
+// Like a build in the activity stream, a build from the webhook where Bamboo found failing tests isn't scanned
+func TestWebhookBuildWithFailedTestsIsSkipped(t *testing.T) {
+    storeFile := tempStoreFile(t)
+    defer os.RemoveAll(filepath.Dir(storeFile))
+    store, err := openStore(storeFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    bamboo := newFakeBamboo()
+    bamboo.results["CRAB-CWS144-33"] = BambooResult{PlanName: "feature-144", BuildState: "Failed", FailedTestCount: 2}
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    build := webhookBuild{
+        recentResult: RecentResult{Link: "https://bamboo.example.com/browse/CRAB-CWS144-33", Published: time.Now()},
+        buildKey:     "CRAB-CWS144",
+        buildNumber:  "33",
+    }
+    handleWebhookBuild(build, bamboo, testRules, store, nil)
+    if len(bamboo.comments["CRAB-CWS144-33"]) != 0 {
+        t.Errorf("expected no comment on CRAB-CWS144-33, but found %v", bamboo.comments["CRAB-CWS144-33"])
+    }
+    record, found, err := store.GetBuild("CRAB-CWS144-33")
+    if err != nil || !found {
+        t.Fatalf("expected to find CRAB-CWS144-33, but found=%v err=%v", found, err)
+    }
+    assertEquals(t, record.Outcome, outcomeTestsFailed)
+}
+
+// Blocks downloading one job's log until released, like a long scan of the activity stream
+type slowBamboo struct {
+    *fakeBamboo
+    slowJob string
+    release chan struct{}
+}
+
+func (bamboo *slowBamboo) DownloadJobLog(job BambooJobResult) (io.ReadCloser, error) {
+    if job.Key == bamboo.slowJob {
+        <-bamboo.release
+    }
+    return bamboo.fakeBamboo.DownloadJobLog(job)
+}
+
+func (bamboo *slowBamboo) commentCount(build string) int {
+    bamboo.mutex.Lock()
+    defer bamboo.mutex.Unlock()
+    return len(bamboo.comments[build])
+}
+
+// A build from the webhook doesn't wait for the scan of the activity stream to finish
+func TestServeScansQueuedBuildsDuringAScan(t *testing.T) {
+    bamboo := &slowBamboo{fakeBamboo: newFakeBamboo(), slowJob: "CRAB-CWS145-JOB1-7", release: make(chan struct{})}
+    bamboo.recentResults = []RecentResult{{Link: "https://bamboo.example.com/browse/CRAB-CWS145-JOB1-7", Published: time.Now()}}
+    bamboo.logs["CRAB-CWS145-JOB1-7"] = readFileToString("test_files/generic.log")
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+
+    dir, err := ioutil.TempDir("", "bambot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    workingDir, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.Chdir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Chdir(workingDir)
+
+    queue := make(chan webhookBuild)
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        serve(bamboo, testRules, nil, nil, time.Hour, 0, defaultWorkers, queue, stop)
+        close(stopped)
+    }()
+
+    queue <- webhookBuild{
+        recentResult: RecentResult{Link: "https://bamboo.example.com/browse/CRAB-CWS144-33", Published: time.Now()},
+        buildKey:     "CRAB-CWS144",
+        buildNumber:  "33",
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for bamboo.commentCount("CRAB-CWS144-33") == 0 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if bamboo.commentCount("CRAB-CWS144-33") != 1 {
+        t.Errorf("expected the build from the webhook to be commented on while the scan was still running")
+    }
+    if bamboo.commentCount("CRAB-CWS145-7") != 0 {
+        t.Errorf("expected the scan to still be running")
+    }
+
+    close(bamboo.release)
+    close(stop)
+    select {
+    case <-stopped:
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected serve to stop")
+    }
+    assertEquals(t, fmt.Sprint(bamboo.commentCount("CRAB-CWS145-7")), "1")
+}
+
+// The same build from the webhook and the activity stream at once is only commented on once
+func TestBuildIsHandledOnceAtATime(t *testing.T) {
+    bamboo := newFakeBamboo()
+    bamboo.logs["CRAB-CWS144-JOB1-33"] = readFileToString("test_files/generic.log")
+    recentResult := RecentResult{Link: "https://bamboo.example.com/browse/CRAB-CWS144-JOB1-33", Published: time.Now()}
+
+    var waitGroup sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            _ = handleBuild(recentResult, bamboo, testRules, nil, nil, newScanStats(), ioutil.Discard)
+        }()
+    }
+    waitGroup.Wait()
+    assertEquals(t, fmt.Sprint(len(bamboo.comments["CRAB-CWS144-33"])), "1")
+    assertEquals(t, fmt.Sprint(len(buildsInProgress.locks)), "0")
+}